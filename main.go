@@ -1,10 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"math"
+	"math/big"
+	"math/bits"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"text/scanner"
+	"time"
+	"unicode/utf8"
 )
 
 // 値
@@ -20,24 +39,118 @@ func (e Value) Eval() Value {
 	return e
 }
 
+// 書式付きの表示 (fmt.Formatter)
+// %v と %s は精度の指定がなければ読み直すと同じ値になる最短の表記にする。
+// precision などの表示の設定は使わない (REPL の表示は formatValue で行う)。
+// それ以外の動詞と精度は float64 と同じように扱う。
+func (e Value) Format(f fmt.State, verb rune) {
+	_, prec := f.Precision()
+	switch {
+	case (verb == 'v' || verb == 's') && !prec:
+		fmt.Fprintf(f, fmt.FormatString(f, 's'), strconv.FormatFloat(float64(e), 'g', -1, 64))
+	case verb == 'v' || verb == 's':
+		fmt.Fprintf(f, fmt.FormatString(f, 'g'), float64(e))
+	default:
+		fmt.Fprintf(f, fmt.FormatString(f, verb), float64(e))
+	}
+}
+
 // 単項演算子
 type Op1 struct {
 	code rune
 	expr Expr
 }
 
+// 評価した演算と関数呼び出しの回数
+var opCount = 0
+
+// 直前の式の opCount
+var lastOps = 0
+
+// 演算を一つ数え、maxCost を超えたらエラーにする
+// 評価前の見積もり (checkCost) では分からない繰り返しの回数もここで止める。
+func countOp() {
+	countOps(1)
+}
+
+// 演算を n 個分数える (big.Int の階乗のように一度の演算が重いとき)
+func countOps(n int) {
+	opCount += n
+	if maxCost > 0 && opCount > maxCost {
+		panic(fmt.Errorf("evaluation too expensive: more than %d operations (maxcost)", maxCost))
+	}
+}
+
 func newOp1(code rune, e Expr) Expr {
 	return &Op1{code, e}
 }
 
 func (e *Op1) Eval() Value {
+	countOp()
 	v := e.expr.Eval()
-	if e.code == '-' {
+	switch e.code {
+	case '-':
 		v = -v
+	case '!':
+		v = factorial(v)
+	case '~':
+		v = bitNot(v)
 	}
 	return v
 }
 
+// ビット反転 (整数のみ)
+func bitNot(v Value) Value {
+	if v != Value(math.Trunc(float64(v))) || math.Abs(float64(v)) > 1<<53 {
+		panic(fmt.Errorf("bitwise not of non-integer: %v", v))
+	}
+	return Value(^int64(v))
+}
+
+// 階乗を float64 で正確に表せる上限 (22! まで)
+const exactFactorial = 22
+
+// float64 で有限になる階乗の上限 (171! は +Inf)
+const maxFactorial = 170
+
+// 階乗
+// exactFactorial を超えると big.Int で計算して最も近い float64 に丸める
+// maxFactorial を超えると big.Int を作らずに +Inf を返す。
+func factorial(v Value) Value {
+	if factorialArg(v) > maxFactorial {
+		return Value(math.Inf(1))
+	}
+	n := bigFactorial(v)
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return Value(f)
+}
+
+// 整数リテラルの階乗が float64 で正確でなければ正確な値を警告する (25!)
+// bigfloat on ならそのまま正確に計算する。
+func checkFactorial(e Expr) {
+	n, ok := e.(Value)
+	if !ok || bigMode || n <= exactFactorial || n > maxFactorial || n != Value(math.Trunc(float64(n))) {
+		return
+	}
+	fmt.Fprintf(warnOutput, "warning: %v! is not exact in float64 (exact: %v; use bigfloat on)\n", n, bigFactorial(n))
+}
+
+// 階乗 (big.Int)
+func bigFactorial(v Value) *big.Int {
+	return new(big.Int).MulRange(1, factorialArg(v))
+}
+
+// 階乗の引数の確認
+func factorialArg(v Value) int64 {
+	x := float64(v)
+	if x < 0 || x != math.Trunc(x) || math.IsInf(x, 0) {
+		panic(fmt.Errorf("factorial: non-negative integer expected: %v", v))
+	} else if x > 100000 {
+		panic(fmt.Errorf("factorial: argument too large: %v", v))
+	}
+	return int64(x)
+}
+
 // 二項演算子
 type Op2 struct {
 	code        rune
@@ -49,6 +162,7 @@ func newOp2(code rune, left, right Expr) Expr {
 }
 
 func (e *Op2) Eval() Value {
+	countOp()
 	x := e.left.Eval()
 	y := e.right.Eval()
 	switch e.code {
@@ -60,43 +174,353 @@ func (e *Op2) Eval() Value {
 		return x * y
 	case '/':
 		return x / y
+	case '^':
+		return Value(math.Pow(float64(x), float64(y)))
+	case '<', '>', tokLe, tokGe, tokEq, tokNe:
+		if compare(e.code, x, y) {
+			return 1
+		}
+		return 0
+	default:
+		panic(fmt.Errorf("invalid op code"))
+	}
+}
+
+// 比較演算
+func compare(code rune, x, y Value) bool {
+	switch code {
+	case '<':
+		return x < y
+	case '>':
+		return x > y
+	case tokLe:
+		return x <= y
+	case tokGe:
+		return x >= y
+	case tokEq:
+		return x == y
+	case tokNe:
+		return x != y
 	default:
 		panic(fmt.Errorf("invalid op code"))
 	}
 }
 
+// 連続した比較 (a < b < c は a < b かつ b < c)
+// 中央の式は一度だけ評価し、偽になったところで打ち切る
+type Chain struct {
+	codes []rune
+	xs    []Expr
+}
+
+func newChain(codes []rune, xs []Expr) *Chain {
+	return &Chain{codes, xs}
+}
+
+func (c *Chain) Eval() Value {
+	x := c.xs[0].Eval()
+	for i, code := range c.codes {
+		y := c.xs[i+1].Eval()
+		if !compare(code, x, y) {
+			return 0
+		}
+		x = y
+	}
+	return 1
+}
+
 // 変数
 type Variable string
 
 // 大域的な環境
 var globalEnv = make(map[Variable]Value)
 
+// 束縛されていない変数を 0 とする (undefined zero)
+var undefinedZero = false
+
 // 変数の評価
 func (v Variable) Eval() Value {
 	val, ok := globalEnv[v]
-	if !ok {
-		panic(fmt.Errorf("unbound variable: %v", v))
+	if !ok && !undefinedZero {
+		panic(unboundError(v))
 	}
 	return val
 }
 
-// 代入演算子
+// 束縛されていない変数の参照
+type unboundError Variable
+
+func (e unboundError) Error() string {
+	return fmt.Sprintf("unbound variable: %v", string(e))
+}
+
+// 代入演算子 (decl なら := による宣言)
 type Agn struct {
 	name Variable
 	expr Expr
+	decl bool
 }
 
 func newAgn(v Variable, e Expr) *Agn {
-	return &Agn{v, e}
+	return &Agn{v, e, false}
+}
+
+func newDecl(v Variable, e Expr) *Agn {
+	return &Agn{v, e, true}
 }
 
+// range で宣言した変数の値の範囲 (下限と上限を含む)
+var rangeTable = make(map[Variable][2]Value)
+
+// freeze で読み出し専用にした変数
+var frozenVars = make(map[Variable]bool)
+
+// watch で代入を表示する変数
+var watchedVars = make(map[Variable]bool)
+
+// 宣言していない変数への = を禁止する
+var strictDecl = false
+
 // 代入演算子の評価
 func (a *Agn) Eval() Value {
 	val := a.expr.Eval()
+	if frozenVars[a.name] {
+		panic(fmt.Errorf("cannot assign to frozen variable: %v", a.name))
+	}
+	_, ok := globalEnv[a.name]
+	if a.decl && ok {
+		panic(fmt.Errorf("variable already declared: %v", a.name))
+	} else if !a.decl && !ok && strictDecl {
+		panic(fmt.Errorf("undeclared variable: %v", a.name))
+	}
+	if r, ok := rangeTable[a.name]; ok && !(val >= r[0] && val <= r[1]) {
+		panic(fmt.Errorf("value out of range: %v = %v not in [%v, %v]", a.name, val, r[0], r[1]))
+	}
+	logUndo(a.name)
 	globalEnv[a.name] = val
+	if watchedVars[a.name] {
+		fmt.Fprintf(output, "%v -> %v\n", a.name, formatValue(val))
+	}
 	return val
 }
 
+// sin(x)/x (0 の近くではテイラー展開の 1 - x^2/6 を使う)
+func sinc(x float64) float64 {
+	if math.Abs(x) < 1e-4 {
+		return 1 - x*x/6
+	}
+	return math.Sin(x) / x
+}
+
+// 偏角 (実数なので正なら 0、負なら π)
+// -0 は 0 とする (math.Atan2(0, -0) は π になる)。
+func arg(x float64) float64 {
+	if math.IsNaN(x) {
+		return x
+	}
+	if x < 0 {
+		return fromRad(math.Pi)
+	}
+	return 0
+}
+
+// min, max で NaN を読み飛ばす
+// 既定では math.Min, math.Max と同じく NaN が一つでもあれば結果は NaN になる。
+// nanskip on では NaN を除いて計算し、すべて NaN のときだけ NaN になる。
+var nanSkip = false
+
+// xs を 2 引数の関数 f で畳み込む (NaN の扱いは nanSkip による)
+func reduceNaN(f func(float64, float64) float64, xs []float64) float64 {
+	r := math.NaN()
+	for i, x := range xs {
+		switch {
+		case math.IsNaN(x) && nanSkip:
+		case i == 0 || (math.IsNaN(r) && nanSkip):
+			r = x
+		default:
+			r = f(r, x)
+		}
+	}
+	return r
+}
+
+// defined(x), defined("x")
+// 変数 x が束縛されていれば 1、そうでなければ 0。
+// 関数や定数は変数ではないので、その名前なら 0 になる。
+func parseDefined(lex *Lex) Expr {
+	if lex.Token != '(' {
+		panic(fmt.Errorf("'(' expected"))
+	}
+	lex.getToken()
+	var name string
+	switch lex.Token {
+	case scanner.Ident:
+		name = lex.text
+		lex.getToken()
+	case scanner.String, scanner.RawString:
+		name = getString(lex)
+	default:
+		panic(fmt.Errorf("defined: variable name expected"))
+	}
+	if lex.Token != ')' {
+		panic(fmt.Errorf("')' expected"))
+	}
+	lex.getToken()
+	return newForm("defined", []Expr{Variable(name)}, evalDefined)
+}
+
+func evalDefined(xs []Expr) Value {
+	if _, ok := globalEnv[xs[0].(Variable)]; ok {
+		return 1
+	}
+	return 0
+}
+
+// 変数 x に sign * n (n の既定値は 1) を足して新しい値を返す
+// incr(x), incr(x, 5), decr(x)
+func step(sign Value) func(map[Variable]Value, []Expr) Value {
+	return func(env map[Variable]Value, xs []Expr) Value {
+		v, ok := xs[0].(Variable)
+		if !ok {
+			panic(fmt.Errorf("variable name expected"))
+		}
+		x, ok := env[v]
+		if !ok && !undefinedZero {
+			panic(unboundError(v))
+		}
+		n := Value(1)
+		if len(xs) > 1 && xs[1] != nil {
+			n = xs[1].Eval()
+		}
+		return newAgn(v, x+sign*n).Eval()
+	}
+}
+
+// tofraction(x), tofraction(x, eps)
+// x に近い分数 p/q を連分数展開で求めて表示し、p/q を返す
+// 誤差 eps (既定値は 1e-6) は approx と同じく相対誤差。
+func parseToFraction(lex *Lex) Expr {
+	xs := getArgs(lex)
+	if len(xs) < 1 || len(xs) > 2 {
+		panic(argcError("tofraction", 1, 2, len(xs)))
+	}
+	return newForm("tofraction", xs, evalToFraction)
+}
+
+func evalToFraction(xs []Expr) Value {
+	x := float64(xs[0].Eval())
+	eps := 1e-6
+	if len(xs) > 1 {
+		eps = float64(xs[1].Eval())
+	}
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		panic(fmt.Errorf("tofraction: not a finite value: %v", x))
+	}
+	if !(eps >= 0) {
+		panic(fmt.Errorf("tofraction: tolerance must be non-negative: %v", eps))
+	}
+	tol := eps * math.Max(1, math.Abs(x))
+	r := math.Abs(x)
+	h0, h1 := 0.0, 1.0
+	k0, k1 := 1.0, 0.0
+	for i := 0; i < 64; i++ {
+		a := math.Floor(r)
+		h0, h1 = h1, a*h1+h0
+		k0, k1 = k1, a*k1+k0
+		if math.Abs(h1/k1-math.Abs(x)) <= tol || r == a || k1 > 1<<53 {
+			break
+		}
+		r = 1 / (r - a)
+	}
+	p := math.Copysign(h1, x)
+	if k1 == 1 {
+		fmt.Fprintln(output, strconv.FormatFloat(p, 'f', -1, 64))
+	} else {
+		fmt.Fprintf(output, "%v/%v\n", strconv.FormatFloat(p, 'f', -1, 64), strconv.FormatFloat(k1, 'f', -1, 64))
+	}
+	return Value(p / k1)
+}
+
+// x を有効数字 n 桁に丸める
+func sigfig(x, n float64) float64 {
+	if n < 1 || n != math.Trunc(n) {
+		panic(fmt.Errorf("sigfig: number of digits must be a positive integer: %v", n))
+	}
+	if x == 0 || math.IsNaN(x) || math.IsInf(x, 0) {
+		return x
+	}
+	p := n - math.Ceil(math.Log10(math.Abs(x)))
+	// p が負なら 10^-p で割ってから掛ける (10^p = 0.01 などは正確に表せない)
+	if p < 0 {
+		m := math.Pow(10, -p)
+		return math.Round(x/m) * m
+	}
+	m := math.Pow(10, p)
+	return math.Round(x*m) / m
+}
+
+// 複数の値を返す関数
+// 値の組はないので、f(x, y).N の形で N 番目の値を選んで使う。
+type tupleFunc struct {
+	argc int // 引数の個数 (負なら 1 個以上の任意個)
+	n    int // 値の個数 (0 なら引数の個数と同じ)
+	fn   func([]float64) []float64
+}
+
+var tupleTable = map[string]tupleFunc{
+	"divmod": {2, 2, func(xs []float64) []float64 {
+		q := math.Floor(xs[0] / xs[1])
+		return []float64{q, xs[0] - q*xs[1]}
+	}},
+	"sort": {-1, 0, sortValues},
+}
+
+// 昇順に並べる (-Inf が先頭、+Inf のあとに NaN を置く)
+func sortValues(xs []float64) []float64 {
+	ys := append([]float64(nil), xs...)
+	sort.Slice(ys, func(i, j int) bool {
+		return ys[i] < ys[j] || (!math.IsNaN(ys[i]) && math.IsNaN(ys[j]))
+	})
+	return ys
+}
+
+// f(x, y).N を N 番目の値を返す関数の呼び出しにする
+// .N は text/scanner では Float のトークンになる。
+func tupleApp(lex *Lex, name string, tf tupleFunc) Expr {
+	xs := getArgs(lex)
+	if tf.argc < 0 && len(xs) == 0 {
+		panic(argcError(name, 1, -1, 0))
+	} else if tf.argc >= 0 && len(xs) != tf.argc {
+		panic(argcError(name, tf.argc, tf.argc, len(xs)))
+	}
+	n := tf.n
+	if n == 0 {
+		n = len(xs)
+	}
+	if lex.Token != scanner.Float || !strings.HasPrefix(lex.text, ".") {
+		panic(fmt.Errorf("%v returns %d values: select one with .0 to .%d", name, n, n-1))
+	}
+	i, err := strconv.Atoi(lex.text[1:])
+	if err != nil || i >= n {
+		panic(fmt.Errorf("%v: invalid component: %v", name, lex.text))
+	}
+	lex.getToken()
+	fn := FuncN(func(xs []float64) float64 { return tf.fn(xs)[i] })
+	return newApp(fmt.Sprintf("%v.%d", name, i), fn, xs)
+}
+
+// 整数 n を b 進数で表示して n を返す (b は 2 から 36)
+func base(n, b float64) float64 {
+	if n != math.Trunc(n) || math.Abs(n) > 1<<53 {
+		panic(fmt.Errorf("base: non-integer value: %v", n))
+	}
+	if b != math.Trunc(b) || b < 2 || b > 36 {
+		panic(fmt.Errorf("base: base out of range: %v", b))
+	}
+	fmt.Fprintln(output, strconv.FormatInt(int64(n), int(b)))
+	return n
+}
+
 // 組み込み関数
 type Func interface {
 	Argc() int
@@ -114,26 +538,136 @@ func (f Func2) Argc() int {
 	return 2
 }
 
+// 変数の環境を受け取る関数 (引数は評価せずに渡す)
+type FuncEnv struct {
+	argc int
+	min  int // 省略できない引数の個数
+	fn   func(env map[Variable]Value, xs []Expr) Value
+}
+
+func (f FuncEnv) Argc() int {
+	return f.argc
+}
+
+// 可変個 (1 個以上) の引数をとる関数 (Argc は -1)
+type FuncN func([]float64) float64
+
+func (f FuncN) Argc() int {
+	return -1
+}
+
+// ユーザ定義関数
+type UserFunc struct {
+	name     string
+	params   []Variable
+	defaults []Expr // 引数の既定値 (なければ nil)
+	body     Expr
+}
+
+func (f *UserFunc) Argc() int {
+	return len(f.params)
+}
+
+// 既定値を持たない引数の個数
+func (f *UserFunc) required() int {
+	n := 0
+	for n < len(f.defaults) && f.defaults[n] == nil {
+		n++
+	}
+	return n
+}
+
+// 再帰の深さ
+var callDepth = 0
+var maxDepth = 1000
+
+// ユーザ定義関数の呼び出し
+// 引数は呼び出し側で評価し、既定値は前の引数を束縛したあとに評価する
+func (f *UserFunc) call(xs []Expr) Value {
+	if callDepth >= maxDepth {
+		panic(fmt.Errorf("maximum recursion depth exceeded: %v", f.name))
+	}
+	callDepth++
+	defer func() { callDepth-- }()
+	vals := make([]Value, len(xs))
+	for i, x := range xs {
+		if x != nil {
+			vals[i] = x.Eval()
+		}
+	}
+	saved := saveVars(f.params)
+	defer restoreVars(saved)
+	for i, p := range f.params {
+		if i < len(xs) && xs[i] != nil {
+			globalEnv[p] = vals[i]
+		} else {
+			globalEnv[p] = f.defaults[i].Eval()
+		}
+	}
+	return f.body.Eval()
+}
+
+// 局所的な束縛のための変数の退避
+type savedVar struct {
+	name Variable
+	val  Value
+	ok   bool
+}
+
+// 退避した変数はこのあと書き換えるので、文の取り消しのためにも記録する。
+func saveVars(vs []Variable) []savedVar {
+	ss := make([]savedVar, len(vs))
+	for i, v := range vs {
+		logUndo(v)
+		val, ok := globalEnv[v]
+		ss[i] = savedVar{v, val, ok}
+	}
+	return ss
+}
+
+func restoreVars(ss []savedVar) {
+	for i := len(ss) - 1; i >= 0; i-- {
+		if ss[i].ok {
+			globalEnv[ss[i].name] = ss[i].val
+		} else {
+			delete(globalEnv, ss[i].name)
+		}
+	}
+}
+
 // 組み込み関数の構文
 type App struct {
-	fn Func
-	xs []Expr
+	name string
+	fn   Func
+	xs   []Expr
 }
 
-func newApp(fn Func, xs []Expr) *App {
-	return &App{fn, xs}
+func newApp(name string, fn Func, xs []Expr) *App {
+	return &App{name, fn, xs}
 }
 
-// 組み込み関数の評価
+// 関数呼び出しの評価
+// 引数は左から順に評価する (f((x = 1), x + 1) の x + 1 は 2)。
 func (a *App) Eval() Value {
+	countOp()
 	switch f := a.fn.(type) {
-	case *Func1:
+	case Func1:
 		x := float64(a.xs[0].Eval())
-		return Value(f.body(x))
-	case *Func2:
+		return Value(f(x))
+	case Func2:
 		x := float64(a.xs[0].Eval())
 		y := float64(a.xs[1].Eval())
-		return Value(f.body(x, y))
+		return Value(f(x, y))
+	case FuncEnv:
+		return f.fn(globalEnv, a.xs)
+	case FuncN:
+		xs := make([]float64, len(a.xs))
+		for i, x := range a.xs {
+			xs[i] = float64(x.Eval())
+		}
+		return Value(f(xs))
+	case *UserFunc:
+		return f.call(a.xs)
 	default:
 		panic(fmt.Errorf("function Eval error"))
 	}
@@ -144,185 +678,3934 @@ var funcTable = make(map[string]Func)
 
 func initFunc() {
 	funcTable["sqrt"] = Func1(math.Sqrt)
-	funcTable["sin"] = Func1(math.Sin)
-	funcTable["cos"] = Func1(math.Cos)
-	funcTable["tan"] = Func1(math.Tan)
+	funcTable["sin"] = trig(math.Sin)
+	funcTable["cos"] = trig(math.Cos)
+	funcTable["tan"] = trig(math.Tan)
 	funcTable["sinh"] = Func1(math.Sinh)
 	funcTable["cosh"] = Func1(math.Cosh)
 	funcTable["tanh"] = Func1(math.Tanh)
-	funcTable["asin"] = Func1(math.Asin)
-	funcTable["acos"] = Func1(math.Acos)
-	funcTable["atan"] = Func1(math.Atan)
-	funcTable["atan2"] = Func2(math.Atan2)
+	funcTable["asin"] = arc(math.Asin)
+	funcTable["acos"] = arc(math.Acos)
+	funcTable["atan"] = arc(math.Atan)
+	funcTable["atan2"] = Func2(func(y, x float64) float64 { return fromRad(math.Atan2(y, x)) })
+	funcTable["arg"] = Func1(arg)
+	funcTable["phase"] = Func1(arg)
 	funcTable["exp"] = Func1(math.Exp)
+	funcTable["exp2"] = Func1(math.Exp2)
+	funcTable["expm1"] = Func1(math.Expm1)
 	funcTable["pow"] = Func2(math.Pow)
 	funcTable["log"] = Func1(math.Log)
 	funcTable["log10"] = Func1(math.Log10)
 	funcTable["log2"] = Func1(math.Log2)
+	funcTable["log1p"] = Func1(math.Log1p)
+	funcTable["approx"] = Func2(approx)
+	funcTable["floor"] = Func1(math.Floor)
+	funcTable["ceil"] = Func1(math.Ceil)
+	funcTable["trunc"] = Func1(math.Trunc)
+	funcTable["frac"] = Func1(func(x float64) float64 { return x - math.Trunc(x) })
+	funcTable["sinc"] = Func1(sinc)
+	funcTable["logistic"] = Func1(func(x float64) float64 { return 1 / (1 + math.Exp(-x)) })
+	funcTable["gamma"] = Func1(math.Gamma)
+	funcTable["erf"] = Func1(math.Erf)
+	funcTable["erfc"] = Func1(math.Erfc)
+	funcTable["erfinv"] = Func1(math.Erfinv)
+	funcTable["base"] = Func2(base)
+	funcTable["sigfig"] = Func2(sigfig)
+	funcTable["incr"] = FuncEnv{2, 1, step(1)}
+	funcTable["decr"] = FuncEnv{2, 1, step(-1)}
+	funcTable["min"] = FuncN(func(xs []float64) float64 { return reduceNaN(math.Min, xs) })
+	funcTable["max"] = FuncN(func(xs []float64) float64 { return reduceNaN(math.Max, xs) })
+	funcTable["normcdf"] = Func1(func(x float64) float64 { return 0.5 * math.Erfc(-x/math.Sqrt2) })
+	funcTable["normpdf"] = Func1(func(x float64) float64 { return math.Exp(-x*x/2) / math.Sqrt(2*math.Pi) })
+	paramTable["atan2"] = []string{"y", "x"}
+	paramTable["pow"] = []string{"base", "exp"}
+	paramTable["approx"] = []string{"a", "b"}
+	for name, fn := range funcTable {
+		builtinFuncs[name] = fn
+	}
 }
 
-// 字句解析
-type Lex struct {
-	scanner.Scanner
-	Token rune
+// 組み込み関数 (initFunc のあとは変更しない。新しいセッションはこれを複製する)
+var builtinFuncs = make(map[string]Func)
+
+// 関数の説明 (名前のあとに ? を付けると表示する)
+var funcDoc = map[string]string{
+	"sqrt":       "square root",
+	"sin":        "sine (angle in the current angle mode)",
+	"cos":        "cosine (angle in the current angle mode)",
+	"tan":        "tangent (angle in the current angle mode)",
+	"sinh":       "hyperbolic sine",
+	"cosh":       "hyperbolic cosine",
+	"tanh":       "hyperbolic tangent",
+	"asin":       "inverse sine (result in the current angle mode)",
+	"acos":       "inverse cosine (result in the current angle mode)",
+	"atan":       "inverse tangent (result in the current angle mode)",
+	"atan2":      "angle of the point (x, y) (result in the current angle mode)",
+	"arg":        "phase angle of x: 0 if x >= 0, pi if x < 0 (current angle mode)",
+	"phase":      "same as arg",
+	"exp":        "e to the power x",
+	"exp2":       "2 to the power x",
+	"expm1":      "exp(x) - 1, accurate for small x",
+	"pow":        "base to the power exp",
+	"log":        "natural logarithm",
+	"log10":      "base-10 logarithm",
+	"log2":       "base-2 logarithm",
+	"log1p":      "log(1 + x), accurate for small x",
+	"approx":     "1 if a and b are equal within eps, else 0",
+	"floor":      "largest integer not greater than x",
+	"ceil":       "smallest integer not less than x",
+	"trunc":      "integer part of x (toward zero)",
+	"frac":       "fractional part of x (x - trunc(x))",
+	"sinc":       "sin(x)/x with sinc(0) = 1",
+	"logistic":   "1 / (1 + exp(-x))",
+	"gamma":      "gamma function",
+	"erf":        "error function",
+	"erfc":       "complementary error function",
+	"erfinv":     "inverse error function",
+	"base":       "print integer x in base y (2 to 36) and return x",
+	"sigfig":     "round x to y significant figures",
+	"tofraction": "print the fraction nearest x within relative error eps (default 1e-6)",
+	"defined":    "1 if variable x is bound, else 0",
+	"incr":       "add y (default 1) to variable x and return the new value",
+	"decr":       "subtract y (default 1) from variable x and return the new value",
+	"min":        "smallest argument (see nanskip)",
+	"max":        "largest argument (see nanskip)",
+	"normcdf":    "standard normal cumulative distribution",
+	"normpdf":    "standard normal density",
+	"divmod":     "floor quotient (.0) and remainder (.1) of x / y",
+	"sort":       "N-th smallest argument with .N (NaN sorts last)",
+	"piecewise":  "first value whose condition is non-zero",
+	"if":         "then if cond is non-zero, otherwise else (only one is evaluated)",
+	"solve":      "root of expr = 0 in x",
+	"integrate":  "definite integral of expr over x from lo to hi",
+	"table":      "print expr for x from lo to hi by step",
+	"plot":       "plot expr for x from lo to hi",
+	"map":        "print fn(x) for x from lo to hi by step",
+	"convert":    "convert value between units",
+	"repeat":     "evaluate expr n times and return the last value",
+	"assert":     "error if cond is 0",
+	"catch":      "value of expr, or fallback if it fails",
+	"eval":       "parse and evaluate the string expr",
+	"currency":   "print x as money ($1,234.50, see currencyfmt) and return x",
 }
 
-func (lex *Lex) getToken() {
-	lex.Token = lex.Scan()
+// 関数の引数と説明の表示
+// sin?;
+func showHelp(name string) {
+	sig := name
+	if fn, ok := funcTable[name]; ok {
+		sig = usage(name, fn)
+	} else if _, ok := specialTable[name]; !ok {
+		if _, ok := tupleTable[name]; !ok {
+			panic(fmt.Errorf("no help available: %v", name))
+		}
+	}
+	if doc, ok := funcDoc[name]; ok {
+		fmt.Fprintf(output, "%v: %v\n", sig, doc)
+	} else {
+		fmt.Fprintln(output, sig)
+	}
 }
 
-// 引数の取得
-func getArgs(lex *Lex) []Expr {
-	e := make([]Expr, 0)
-	if lex.Token != '(' {
-		panic(fmt.Errorf("'(' expected"))
+// 関数の呼び出し方 (pow(base, exp))
+func usage(name string, fn Func) string {
+	if f, user := fn.(*UserFunc); user {
+		return signature(f)
+	} else if fn.Argc() < 0 {
+		return name + "(x, ...)"
 	}
-	lex.getToken()
-	if lex.Token == ')' {
-		lex.getToken()
-		return e
+	return name + "(" + strings.Join(paramNames(name, fn), ", ") + ")"
+}
+
+// approx の許容誤差 (相対誤差)
+var epsilon = 1e-9
+
+// a と b がほぼ等しければ 1、そうでなければ 0
+func approx(a, b float64) float64 {
+	if math.Abs(a-b) <= epsilon*math.Max(1, math.Max(math.Abs(a), math.Abs(b))) {
+		return 1
 	}
-	for {
-		e = append(e, expression(lex))
-		switch lex.Token {
-		case ')':
-			lex.getToken()
-			return e
-		case ',':
-			lex.getToken()
-		default:
-			panic(fmt.Errorf("unexpected token in argument list"))
+	return 0
+}
+
+// 角度の単位 (rad, deg, grad)
+var angleMode = "rad"
+
+// 半回転 (π ラジアン) の大きさ
+var angleUnits = map[string]float64{"rad": math.Pi, "deg": 180, "grad": 200}
+
+func toRad(x float64) float64 {
+	if angleMode == "rad" {
+		return x
+	}
+	return x * math.Pi / angleUnits[angleMode]
+}
+
+func fromRad(x float64) float64 {
+	if angleMode == "rad" {
+		return x
+	}
+	return x * angleUnits[angleMode] / math.Pi
+}
+
+// 角度を引数に取る三角関数
+func trig(f func(float64) float64) Func1 {
+	return func(x float64) float64 { return f(toRad(x)) }
+}
+
+// 角度を返す逆三角関数
+func arc(f func(float64) float64) Func1 {
+	return func(x float64) float64 { return fromRad(f(x)) }
+}
+
+// 引数名 (登録がなければ x, y, ... とする)
+var paramTable = make(map[string][]string)
+
+func paramNames(name string, fn Func) []string {
+	if f, ok := fn.(*UserFunc); ok {
+		ps := make([]string, len(f.params))
+		for i, p := range f.params {
+			ps[i] = string(p)
 		}
+		return ps
+	}
+	ps, ok := paramTable[name]
+	if ok {
+		return ps
 	}
+	ps = make([]string, fn.Argc())
+	for i := range ps {
+		ps[i] = string(rune('x' + i))
+	}
+	return ps
 }
 
-// 因子
-func factor(lex *Lex) Expr {
-	switch lex.Token {
-	case '(':
-		lex.getToken()
-		e := expression(lex)
-		if lex.Token != ')' {
-			panic(fmt.Errorf("')' expected"))
+// キーワード引数を引数の位置に割り当てる
+func bindArgs(name string, fn Func, xs []Expr, kws []*Agn) []Expr {
+	if len(kws) == 0 {
+		return xs
+	}
+	if _, ok := fn.(FuncN); ok {
+		panic(fmt.Errorf("keyword arguments not allowed: %v", name))
+	}
+	ps := paramNames(name, fn)
+	if len(xs) > len(ps) {
+		panic(argcError(name, len(ps), len(ps), len(xs)))
+	}
+	args := make([]Expr, len(ps))
+	copy(args, xs)
+	for _, kw := range kws {
+		i := 0
+		for i < len(ps) && ps[i] != string(kw.name) {
+			i++
 		}
-		lex.getToken()
-		return e
-	case '+':
-		lex.getToken()
-		return newOp1('+', factor(lex))
-	case '-':
-		lex.getToken()
-		return newOp1('-', factor(lex))
-	case scanner.Int, scanner.Float:
-		var n float64
-		fmt.Sscan(lex.TokenText(), &n)
-		lex.getToken()
-		return Value(n)
-	case scanner.Ident:
-		name := lex.TokenText()
-		lex.getToken()
-		if name == "quit" {
-			panic(name)
+		if i == len(ps) {
+			panic(fmt.Errorf("unknown parameter: %v(%v=)", name, kw.name))
+		} else if args[i] != nil {
+			panic(fmt.Errorf("duplicate argument: %v(%v=)", name, kw.name))
 		}
-		v, ok := funcTable[name]
-		if ok {
-			xs := getArgs(lex)
-			if len(xs) != v.Argc() {
-				panic(fmt.Errorf("wrong number of arguments: %v", name))
-			}
-			return newApp(v, xs)
-		} else {
-			return Variable(name)
+		args[i] = kw.expr
+	}
+	for i, x := range args {
+		if x == nil && !hasDefault(fn, i) {
+			panic(fmt.Errorf("missing argument: %v(%v=)", name, ps[i]))
 		}
-	default:
-		panic(fmt.Errorf("unexpected token: %v", lex.TokenText()))
 	}
+	return args
 }
 
-// 項
-func term(lex *Lex) Expr {
-	e := factor(lex)
-	for {
-		switch lex.Token {
-		case '*':
-			lex.getToken()
-			e = newOp2('*', e, factor(lex))
-		case '/':
-			lex.getToken()
-			e = newOp2('/', e, factor(lex))
-		default:
-			return e
-		}
+// i 番目の引数が既定値を持つか
+func hasDefault(fn Func, i int) bool {
+	if f, ok := fn.(FuncEnv); ok {
+		return i >= f.min
 	}
+	f, ok := fn.(*UserFunc)
+	return ok && f.defaults[i] != nil
 }
 
-// 式
-func expr1(lex *Lex) Expr {
-	e := term(lex)
+// 引数の個数の確認
+func checkArgc(name string, fn Func, xs []Expr) {
+	if _, ok := fn.(FuncN); ok {
+		if len(xs) == 0 {
+			panic(fmt.Errorf("%v (usage: %v)", argcError(name, 1, -1, 0), usage(name, fn)))
+		}
+		return
+	}
+	min := fn.Argc()
+	if f, ok := fn.(*UserFunc); ok {
+		min = f.required()
+	} else if f, ok := fn.(FuncEnv); ok {
+		min = f.min
+	}
+	if len(xs) < min || len(xs) > fn.Argc() {
+		panic(fmt.Errorf("%v (usage: %v)", argcError(name, min, fn.Argc(), len(xs)), usage(name, fn)))
+	}
+}
+
+// 引数の個数のエラー (max が負なら上限なし)
+// pow expects 2 arguments, got 1
+func argcError(name string, min, max, got int) error {
+	want := fmt.Sprint(min)
+	if max < 0 {
+		want = "at least " + want
+	} else if max != min {
+		want = fmt.Sprintf("%v to %v", min, max)
+	}
+	plural := "s"
+	if max == 1 || (max < 0 && min == 1) {
+		plural = ""
+	}
+	return fmt.Errorf("%v expects %v argument%v, got %v", name, want, plural, got)
+}
+
+// 組み込みの定数
+var constTable = map[string]Value{
+	"nan": Value(math.NaN()),
+	"inf": Value(math.Inf(1)),
+}
+
+// define で定義した定数 (再代入できない)
+var defineTable = map[string]Value{}
+
+// 定数の検索 (組み込みの定数が優先)
+func lookupConst(name string) (Value, bool) {
+	if c, ok := constTable[name]; ok {
+		return c, true
+	}
+	c, ok := defineTable[name]
+	return c, ok
+}
+
+// 特殊形式 (引数を評価せずに受け取る)
+type Form struct {
+	name string
+	xs   []Expr
+	fn   func([]Expr) Value
+	lits []string // fn が覚えている文字列の引数 (通貨記号、assert のメッセージ)
+}
+
+func newForm(name string, xs []Expr, fn func([]Expr) Value) *Form {
+	return &Form{name: name, xs: xs, fn: fn}
+}
+
+// 特殊形式の評価
+func (f *Form) Eval() Value {
+	return f.fn(f.xs)
+}
+
+// 特殊形式の初期化
+var specialTable = make(map[string]func(*Lex) Expr)
+
+func initSpecial() {
+	specialTable["piecewise"] = parsePiecewise
+	specialTable["if"] = parseIf
+	specialTable["tofraction"] = parseToFraction
+	specialTable["solve"] = parseSolve
+	specialTable["integrate"] = parseIntegrate
+	specialTable["table"] = parseTable
+	specialTable["plot"] = parsePlot
+	specialTable["map"] = parseMap
+	specialTable["convert"] = parseConvert
+	specialTable["repeat"] = parseRepeat
+	specialTable["assert"] = parseAssert
+	specialTable["catch"] = parseCatch
+	specialTable["eval"] = parseEval
+	specialTable["currency"] = parseCurrency
+	specialTable["defined"] = parseDefined
+}
+
+// 変数 v を局所的に束縛して e を x の関数として評価する
+// 使い終わったら restore で元の束縛に戻す
+func bindLocal(v Variable, e Expr) (f func(float64) float64, restore func()) {
+	saved := saveVars([]Variable{v})
+	f = func(x float64) float64 {
+		countOp()
+		globalEnv[v] = Value(x)
+		return float64(e.Eval())
+	}
+	return f, func() { restoreVars(saved) }
+}
+
+// 特殊形式の引数の個数と変数の位置の確認
+func checkForm(name string, xs []Expr, min, max, varPos int) {
+	if len(xs) < min || len(xs) > max {
+		panic(argcError(name, min, max, len(xs)))
+	}
+	if _, ok := xs[varPos].(Variable); !ok {
+		panic(fmt.Errorf("%v: variable expected", name))
+	}
+}
+
+// piecewise(cond1, val1, cond2, val2, ..., default)
+// 条件は 0 以外を真とし、最初に真となった条件の値だけを評価する
+func parsePiecewise(lex *Lex) Expr {
+	xs := getArgs(lex)
+	if len(xs)%2 == 0 {
+		panic(fmt.Errorf("piecewise: default value expected"))
+	}
+	return newForm("piecewise", xs, evalPiecewise)
+}
+
+// if(cond, then, else)
+// piecewise と同じく選ばれた枝だけを評価する
+func parseIf(lex *Lex) Expr {
+	xs := exprArgs(lex)
+	if len(xs) != 3 {
+		panic(argcError("if", 3, 3, len(xs)))
+	}
+	return newForm("if", xs, evalPiecewise)
+}
+
+func evalPiecewise(xs []Expr) Value {
+	for i := 0; i+1 < len(xs); i += 2 {
+		if xs[i].Eval() != 0 {
+			return xs[i+1].Eval()
+		}
+	}
+	return xs[len(xs)-1].Eval()
+}
+
+// 複数文字の演算子のトークン
+const (
+	tokDecl  rune = -(iota + 100) // :=
+	tokPow                        // **
+	tokLe                         // <=
+	tokGe                         // >=
+	tokEq                         // ==
+	tokNe                         // !=
+	tokElvis                      // ?:
+	tokDMS                        // 30d15m20s
+)
+
+// 2 文字の演算子とトークンの対応
+// 隣り合う 2 文字がこの表にあれば 1 つのトークンにまとめる。
+// // は text/scanner がコメントとして読み飛ばすので使えない。
+var opTokens = map[string]rune{
+	":=": tokDecl,
+	"**": tokPow,
+	"<=": tokLe,
+	">=": tokGe,
+	"==": tokEq,
+	"!=": tokNe,
+	"?:": tokElvis,
+}
+
+// solve(expr, x), solve(expr, x, seed), solve(expr, x, lo, hi)
+// expr = 0 となる x を数値的に一つ求める。
+// lo, hi を与えると二分法で探す (両端で expr の符号が異なること)。
+// そうでなければ seed (既定値 0) からニュートン法 (微分は数値的に近似) で探すので、
+// seed に近い根が得られるとは限らず、極値の近くでは収束しないこともある。
+func parseSolve(lex *Lex) Expr {
+	xs := getArgs(lex)
+	checkForm("solve", xs, 2, 4, 1)
+	return newForm("solve", xs, evalSolve)
+}
+
+func evalSolve(xs []Expr) Value {
+	args := make([]float64, len(xs)-2)
+	for i, x := range xs[2:] {
+		args[i] = float64(x.Eval())
+	}
+	f, restore := bindLocal(xs[1].(Variable), xs[0])
+	defer restore()
+	switch len(args) {
+	case 2:
+		return Value(bisect(f, args[0], args[1]))
+	case 1:
+		return Value(newton(f, args[0]))
+	default:
+		return Value(newton(f, 0))
+	}
+}
+
+// 二分法
+func bisect(f func(float64) float64, lo, hi float64) float64 {
+	flo, fhi := f(lo), f(hi)
+	if flo == 0 {
+		return lo
+	} else if fhi == 0 {
+		return hi
+	} else if math.Signbit(flo) == math.Signbit(fhi) {
+		panic(fmt.Errorf("solve: no sign change between %v and %v", lo, hi))
+	}
+	for i := 0; i < 200; i++ {
+		mid := lo + (hi-lo)/2
+		fmid := f(mid)
+		if fmid == 0 || mid == lo || mid == hi {
+			return mid
+		}
+		if math.Signbit(fmid) == math.Signbit(flo) {
+			lo, flo = mid, fmid
+		} else {
+			hi = mid
+		}
+	}
+	return lo + (hi-lo)/2
+}
+
+// ニュートン法
+func newton(f func(float64) float64, x float64) float64 {
+	for i := 0; i < 100; i++ {
+		fx := f(x)
+		if fx == 0 {
+			return x
+		}
+		h := 1e-6 * math.Max(1, math.Abs(x))
+		d := (f(x+h) - f(x-h)) / (2 * h)
+		if d == 0 {
+			// 極値で止まらないように少しずらす
+			x += 0.1 * math.Max(1, math.Abs(x))
+			continue
+		} else if math.IsNaN(d) || math.IsInf(d, 0) {
+			break
+		}
+		dx := fx / d
+		x -= dx
+		if math.Abs(dx) <= 1e-12*math.Max(1, math.Abs(x)) {
+			return x
+		}
+	}
+	panic(fmt.Errorf("solve: did not converge"))
+}
+
+// integrate の分割数 (偶数)
+var subdivisions = 1000
+
+// integrate(expr, x, lo, hi)
+// lo から hi までの定積分をシンプソン則で求める
+func parseIntegrate(lex *Lex) Expr {
+	xs := getArgs(lex)
+	checkForm("integrate", xs, 4, 4, 1)
+	return newForm("integrate", xs, evalIntegrate)
+}
+
+func evalIntegrate(xs []Expr) Value {
+	lo := float64(xs[2].Eval())
+	hi := float64(xs[3].Eval())
+	f, restore := bindLocal(xs[1].(Variable), xs[0])
+	defer restore()
+	n := subdivisions
+	h := (hi - lo) / float64(n)
+	sum := f(lo) + f(hi)
+	for i := 1; i < n; i++ {
+		if i%2 == 1 {
+			sum += 4 * f(lo+float64(i)*h)
+		} else {
+			sum += 2 * f(lo+float64(i)*h)
+		}
+	}
+	return Value(sum * h / 3)
+}
+
+// table(expr, x, lo, hi, step)
+// x を lo から step ずつ変えて x と expr の値の表を表示し、行数を返す。
+// hi は step の誤差の範囲で含め、超えることはない。
+func parseTable(lex *Lex) Expr {
+	xs := getArgs(lex)
+	checkForm("table", xs, 5, 5, 1)
+	return newForm("table", xs, evalTable)
+}
+
+func evalTable(xs []Expr) Value {
+	lo := float64(xs[2].Eval())
+	hi := float64(xs[3].Eval())
+	step := float64(xs[4].Eval())
+	f, restore := bindLocal(xs[1].(Variable), xs[0])
+	defer restore()
+	n := steps(lo, hi, step)
+	rows := make([][]string, n)
+	for i := 0; i < n; i++ {
+		x := lo + float64(i)*step
+		rows[i] = []string{formatValue(Value(x)), formatValue(Value(f(x)))}
+	}
+	printTable(rows)
+	return Value(n)
+}
+
+// table, map の列の幅の最小値
+var tableWidth = 0
+
+// 列ごとに小数点の位置をそろえて表を表示する
+func printTable(rows [][]string) {
+	if len(rows) == 0 {
+		return
+	}
+	intw := make([]int, len(rows[0]))
+	fracw := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for j, c := range row {
+			i, f := splitPoint(c)
+			intw[j] = max(intw[j], utf8.RuneCountInString(i))
+			fracw[j] = max(fracw[j], utf8.RuneCountInString(f))
+		}
+	}
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for j, c := range row {
+			i, f := splitPoint(c)
+			c = strings.Repeat(" ", intw[j]-utf8.RuneCountInString(i)) + i + f +
+				strings.Repeat(" ", fracw[j]-utf8.RuneCountInString(f))
+			cells[j] = fmt.Sprintf("%*s", tableWidth, c)
+		}
+		fmt.Fprintln(output, strings.TrimRight(strings.Join(cells, "  "), " "))
+	}
+}
+
+// 小数点より前と、小数点から後に分ける
+// formatValue は decimalsep comma でも小数点に . を使い、コンマは桁の区切りになりうる。
+func splitPoint(s string) (string, string) {
+	if i := strings.Index(s, "."); i >= 0 {
+		return s[:i], s[i:]
+	}
+	return s, ""
+}
+
+// table, map で表示する行の数の上限
+const maxSteps = 100000
+
+// lo から hi まで step ずつ進むときの点の数
+func steps(lo, hi, step float64) int {
+	if math.IsNaN(lo) || math.IsInf(lo, 0) || math.IsNaN(hi) || math.IsInf(hi, 0) {
+		panic(fmt.Errorf("invalid range: %v to %v", lo, hi))
+	}
+	if step == 0 || math.IsNaN(step) || math.IsInf(step, 0) || (hi-lo)/step < 0 {
+		panic(fmt.Errorf("invalid step: %v", step))
+	}
+	n := math.Floor((hi-lo)/step+1e-9) + 1
+	if n > maxSteps {
+		panic(fmt.Errorf("too many steps: %.0f exceeds %v", n, maxSteps))
+	}
+	return int(n)
+}
+
+// plot の大きさ (文字数)
+var plotWidth = 60
+var plotHeight = 20
+
+// plot(expr, x, lo, hi)
+// x を lo から hi まで plotWidth 点で標本化してグラフを表示し、点の数を返す
+func parsePlot(lex *Lex) Expr {
+	xs := getArgs(lex)
+	checkForm("plot", xs, 4, 4, 1)
+	return newForm("plot", xs, evalPlot)
+}
+
+func evalPlot(xs []Expr) Value {
+	lo := float64(xs[2].Eval())
+	hi := float64(xs[3].Eval())
+	f, restore := bindLocal(xs[1].(Variable), xs[0])
+	defer restore()
+	ys := make([]float64, plotWidth)
+	ymin, ymax := math.Inf(1), math.Inf(-1)
+	for i := range ys {
+		ys[i] = f(lo + (hi-lo)*float64(i)/float64(plotWidth-1))
+		if !math.IsNaN(ys[i]) && !math.IsInf(ys[i], 0) {
+			ymin = math.Min(ymin, ys[i])
+			ymax = math.Max(ymax, ys[i])
+		}
+	}
+	if ymin > ymax {
+		panic(fmt.Errorf("plot: no finite values"))
+	}
+	// 行番号 (上が 0) への変換
+	row := func(y float64) int {
+		if ymax == ymin {
+			return plotHeight / 2
+		}
+		return int(math.Round((ymax - y) / (ymax - ymin) * float64(plotHeight-1)))
+	}
+	grid := make([][]byte, plotHeight)
+	for r := range grid {
+		grid[r] = bytes.Repeat([]byte{' '}, plotWidth)
+	}
+	if ymin <= 0 && 0 <= ymax {
+		copy(grid[row(0)], bytes.Repeat([]byte{'-'}, plotWidth))
+	}
+	for i, y := range ys {
+		if !math.IsNaN(y) && !math.IsInf(y, 0) {
+			grid[row(y)][i] = '*'
+		}
+	}
+	fmt.Fprintln(output, formatValue(Value(ymax)))
+	for _, line := range grid {
+		fmt.Fprintln(output, "|"+string(line))
+	}
+	fmt.Fprintln(output, formatValue(Value(ymin)))
+	return Value(plotWidth)
+}
+
+// map(fn, lo, hi, step)
+// 1 引数の関数 fn の値を lo から step ずつ表示し、行数を返す
+func parseMap(lex *Lex) Expr {
+	if lex.Token != '(' {
+		panic(fmt.Errorf("'(' expected"))
+	}
+	lex.getToken()
+	name := lex.text
+	fn, ok := funcTable[name]
+	if lex.Token != scanner.Ident || !ok || fn.Argc() != 1 {
+		panic(fmt.Errorf("map: single-argument function expected: %v", name))
+	}
+	lex.getToken()
+	if lex.Token != argSep() {
+		panic(fmt.Errorf("unexpected token in argument list"))
+	}
+	// 区切りを '(' とみなして残りの引数を読む
+	lex.Token = '('
+	xs := append([]Expr{Variable(name)}, getArgs(lex)...)
+	if len(xs) != 4 {
+		panic(argcError("map", 4, 4, len(xs)))
+	}
+	return newForm("map", xs, evalMap)
+}
+
+func evalMap(xs []Expr) Value {
+	name := string(xs[0].(Variable))
+	fn, ok := funcTable[name]
+	if !ok || fn.Argc() != 1 {
+		panic(fmt.Errorf("map: single-argument function expected: %v", name))
+	}
+	lo := float64(xs[1].Eval())
+	hi := float64(xs[2].Eval())
+	step := float64(xs[3].Eval())
+	n := steps(lo, hi, step)
+	rows := make([][]string, n)
+	for i := 0; i < n; i++ {
+		x := Value(lo + float64(i)*step)
+		y := newApp(name, fn, []Expr{x}).Eval()
+		rows[i] = []string{formatValue(x), formatValue(y)}
+	}
+	printTable(rows)
+	return Value(n)
+}
+
+// repeat(expr, n)
+// expr を n 回評価して最後の値を返す (n が 0 なら 0)。
+// expr には代入を書ける (repeat(x = x + 1, 1000))。
+func parseRepeat(lex *Lex) Expr {
+	xs := exprArgs(lex)
+	if len(xs) != 2 {
+		panic(argcError("repeat", 2, 2, len(xs)))
+	}
+	return newForm("repeat", xs, evalRepeat)
+}
+
+// catch(expr, fallback)
+// expr の評価でエラーが起きたら fallback を評価して返す
+func parseCatch(lex *Lex) Expr {
+	xs := exprArgs(lex)
+	if len(xs) != 2 {
+		panic(argcError("catch", 2, 2, len(xs)))
+	}
+	return newForm("catch", xs, func(xs []Expr) Value {
+		if v, ok := tryEval(xs[0], func(error) bool { return true }); ok {
+			return v
+		}
+		return xs[1].Eval()
+	})
+}
+
+func evalRepeat(xs []Expr) Value {
+	n := float64(xs[1].Eval())
+	if n < 0 || n != math.Trunc(n) || math.IsInf(n, 0) {
+		panic(fmt.Errorf("repeat: count must be a non-negative integer: %v", n))
+	}
+	var v Value
+	for i := 0; i < int(n); i++ {
+		countOp()
+		v = xs[0].Eval()
+	}
+	return v
+}
+
+// assert(cond), assert(cond, "message")
+// cond が 0 ならエラーにする (メッセージがなければ cond の原文を表示する)。成功すれば 1 を返す。
+func parseAssert(lex *Lex) Expr {
+	if lex.Token != '(' {
+		panic(fmt.Errorf("'(' expected"))
+	}
+	lex.getToken()
+	start := lex.pos
+	cond := expression(lex)
+	mes := strings.TrimSpace(lex.rec.text(start, lex.pos))
+	var lits []string
+	if lex.Token == argSep() {
+		lex.getToken()
+		mes = getString(lex)
+		lits = []string{mes}
+	}
+	if lex.Token != ')' {
+		panic(fmt.Errorf("')' expected"))
+	}
+	lex.getToken()
+	f := newForm("assert", []Expr{cond}, func(xs []Expr) Value {
+		if xs[0].Eval() == 0 {
+			panic(fmt.Errorf("assertion failed: %v", mes))
+		}
+		return 1
+	})
+	f.lits = lits
+	return f
+}
+
+// eval("2 + x"), eval(`...`)
+// 文字列の式を評価のたびに構文解析して評価する (あとで定義した関数も使える)。
+func parseEval(lex *Lex) Expr {
+	if lex.Token != '(' {
+		panic(fmt.Errorf("'(' expected"))
+	}
+	lex.getToken()
+	src := getString(lex)
+	if lex.Token != ')' {
+		panic(fmt.Errorf("')' expected"))
+	}
+	lex.getToken()
+	return EvalStr(src)
+}
+
+// eval の文字列の式
+type EvalStr string
+
+func (s EvalStr) Eval() Value {
+	if callDepth >= maxDepth {
+		panic(fmt.Errorf("maximum recursion depth exceeded: eval"))
+	}
+	callDepth++
+	defer func() { callDepth-- }()
+	e, err := Parse(string(s))
+	if err != nil {
+		panic(fmt.Errorf("eval: %v", err))
+	}
+	checkCost(e)
+	return e.Eval()
+}
+
+// currency の通貨記号と小数点以下の桁数
+var currencySymbol = "$"
+var currencyDigits = 2
+
+// currency(x), currency(x, "€")
+// x を通貨の形式 ($1,234.50、負なら -$1,234.50) で表示して x を返す
+func parseCurrency(lex *Lex) Expr {
+	if lex.Token != '(' {
+		panic(fmt.Errorf("'(' expected"))
+	}
+	lex.getToken()
+	x := expression(lex)
+	sym := ""
+	custom := false
+	if lex.Token == argSep() {
+		lex.getToken()
+		sym, custom = getString(lex), true
+	}
+	if lex.Token != ')' {
+		panic(fmt.Errorf("')' expected"))
+	}
+	lex.getToken()
+	f := newForm("currency", []Expr{x}, func(xs []Expr) Value {
+		if !custom {
+			sym = currencySymbol
+		}
+		v := xs[0].Eval()
+		fmt.Fprintln(output, formatCurrency(float64(v), sym))
+		return v
+	})
+	if custom {
+		f.lits = []string{sym}
+	}
+	return f
+}
+
+func formatCurrency(x float64, sym string) string {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	s := groupDigits(strconv.FormatFloat(math.Abs(x), 'f', currencyDigits, 64), groupSep)
+	if x < 0 && strings.Trim(s, "0.,") != "" {
+		return "-" + sym + s
+	}
+	return sym + s
+}
+
+// 単位 (基準の単位での値 = (値 + offset) * num / den)
+// 華氏の 5/9 のように割り切れない倍率は num と den に分けて、100 °C → 212 °F などを正確にする。
+type unit struct {
+	dim      string
+	num, den float64
+	offset   float64
+}
+
+var unitTable = map[string]unit{
+	"m":          {"length", 1, 1, 0},
+	"km":         {"length", 1000, 1, 0},
+	"cm":         {"length", 0.01, 1, 0},
+	"mm":         {"length", 0.001, 1, 0},
+	"mile":       {"length", 1609.344, 1, 0},
+	"yard":       {"length", 0.9144, 1, 0},
+	"ft":         {"length", 0.3048, 1, 0},
+	"inch":       {"length", 0.0254, 1, 0},
+	"kg":         {"mass", 1, 1, 0},
+	"g":          {"mass", 0.001, 1, 0},
+	"lb":         {"mass", 0.45359237, 1, 0},
+	"oz":         {"mass", 0.028349523125, 1, 0},
+	"s":          {"time", 1, 1, 0},
+	"min":        {"time", 60, 1, 0},
+	"hour":       {"time", 3600, 1, 0},
+	"day":        {"time", 86400, 1, 0},
+	"l":          {"volume", 1, 1, 0},
+	"ml":         {"volume", 0.001, 1, 0},
+	"gallon":     {"volume", 3.785411784, 1, 0},
+	"celsius":    {"temperature", 1, 1, 0},
+	"kelvin":     {"temperature", 1, 1, -273.15},
+	"fahrenheit": {"temperature", 5, 9, -32},
+}
+
+// convert(value, from, to)
+// 単位は名前か文字列で書く (convert(100, km, mile), convert(20, "celsius", "fahrenheit"))
+func parseConvert(lex *Lex) Expr {
+	if lex.Token != '(' {
+		panic(fmt.Errorf("'(' expected"))
+	}
+	lex.getToken()
+	xs := []Expr{expression(lex)}
+	for i := 0; i < 2; i++ {
+		if lex.Token != argSep() {
+			panic(fmt.Errorf("unexpected token in argument list"))
+		}
+		lex.getToken()
+		xs = append(xs, Variable(unitName(lex)))
+	}
+	if lex.Token != ')' {
+		panic(fmt.Errorf("')' expected"))
+	}
+	lex.getToken()
+	from := unitTable[string(xs[1].(Variable))]
+	to := unitTable[string(xs[2].(Variable))]
+	if from.dim != to.dim {
+		panic(fmt.Errorf("convert: incompatible units: %v and %v", xs[1], xs[2]))
+	}
+	return newForm("convert", xs, evalConvert)
+}
+
+// 単位名の取得
+func unitName(lex *Lex) string {
+	var name string
+	switch lex.Token {
+	case scanner.Ident:
+		name = lex.text
+		lex.getToken()
+	case scanner.String, scanner.RawString:
+		name = getString(lex)
+	default:
+		panic(fmt.Errorf("convert: unit name expected"))
+	}
+	if _, ok := unitTable[name]; !ok {
+		panic(fmt.Errorf("convert: unknown unit: %v", name))
+	}
+	return name
+}
+
+func evalConvert(xs []Expr) Value {
+	from := unitTable[string(xs[1].(Variable))]
+	to := unitTable[string(xs[2].(Variable))]
+	x := (float64(xs[0].Eval()) + from.offset) * from.num / from.den
+	return Value(x*to.den/to.num - to.offset)
+}
+
+// 字句解析
+type Lex struct {
+	scanner.Scanner
+	Token  rune
+	text   string // Token の文字列
+	pos    int    // Token の入力中の位置
+	src    io.Reader
+	rec    *recorder
+	more   bool // 式の途中なら改行で継続プロンプトを表示する
+	prompt bool // プロンプトを表示する
+	keep   bool // 評価した式の文を stmts に残す
+	stmts  []Expr
+
+	// 先読みしたトークン
+	ahead     bool
+	aheadTok  rune
+	aheadText string
+	aheadPos  int
+}
+
+// 読み込んだ入力の記録 (文の原文を取り出すため)
+type recorder struct {
+	r    io.Reader
+	buf  []byte
+	base int // buf[0] の入力中の位置
+}
+
+func (rec *recorder) Read(p []byte) (int, error) {
+	n, err := rec.r.Read(p)
+	rec.buf = append(rec.buf, p[:n]...)
+	return n, err
+}
+
+// 入力中の位置 from から to までの文字列
+func (rec *recorder) text(from, to int) string {
+	return string(rec.buf[from-rec.base : to-rec.base])
+}
+
+// 位置 off より前の記録を捨てる
+func (rec *recorder) drop(off int) {
+	rec.buf = append([]byte(nil), rec.buf[off-rec.base:]...)
+	rec.base = off
+}
+
+// 字句解析器の生成
+// Lex は一つの入力 src に対応し、toplevel などで使い回す間は
+// Token や継続中の状態を持ち越す。別の入力を解析するときは
+// newLex で作り直すか reset を呼ぶ。
+func newLex(src io.Reader) *Lex {
+	lex := new(Lex)
+	lex.reset(src)
+	return lex
+}
+
+// src を入力として初期状態に戻す (改行はトークンとして扱う)
+func (lex *Lex) reset(src io.Reader) {
+	lex.rec = &recorder{r: src}
+	lex.Init(lex.rec)
+	lex.Whitespace &^= 1 << '\n'
+	lex.Token = 0
+	lex.text = ""
+	lex.pos = 0
+	lex.src = src
+	lex.more = false
+	lex.ahead = false
+}
+
+func (lex *Lex) getToken() {
+	if lex.ahead {
+		lex.Token, lex.text, lex.pos = lex.aheadTok, lex.aheadText, lex.aheadPos
+		lex.ahead = false
+		return
+	}
 	for {
-		switch lex.Token {
-		case '+':
+		lex.scan()
+		switch {
+		case lex.Token == '\n' && lex.more:
+			if lex.prompt {
+				fmt.Fprint(output, "...> ")
+			}
+		case lex.Token == '\n':
+		case lex.Token == scanner.EOF && lex.more:
+			// 継続中の EOF (Ctrl-D) は入力途中の式を取り消す
+			if lex.prompt {
+				fmt.Fprintln(output)
+			}
+			// 入力の記録も作り直すので、取り消した文の位置はもう使えない
+			lex.reset(lex.src)
+			lex.Token = '\n'
+			panic(errCanceled)
+		default:
+			return
+		}
+	}
+}
+
+// 継続中の EOF で入力途中の式を取り消したときのエラー
+var errCanceled = fmt.Errorf("input canceled")
+
+// 改行も含めて次のトークンを読む
+func (lex *Lex) scan() {
+	lex.Token = lex.Scan()
+	lex.text = lex.TokenText()
+	lex.pos = lex.Offset
+	op := lex.text + string(lex.Peek())
+	if tok, ok := opTokens[op]; ok && lex.Token > 0 {
+		lex.Next()
+		lex.Token, lex.text = tok, op
+	} else if lex.Token == scanner.Int && decimalComma && lex.Peek() == ',' {
+		// 3,14 を 3.14 として読む
+		lex.Next()
+		text := lex.text + "."
+		if c := lex.Peek(); '0' <= c && c <= '9' {
+			lex.Scan()
+			text += lex.TokenText()
+		}
+		lex.Token, lex.text = scanner.Float, text
+	} else if lex.Token == scanner.Int && lex.Peek() == 'd' {
+		// 30d15m20s を度分秒のリテラルとして読む
+		text := lex.text
+		for c := lex.Peek(); c == 'd' || c == 'm' || c == 's' || c == '.' || '0' <= c && c <= '9'; c = lex.Peek() {
+			text += string(lex.Next())
+		}
+		lex.Token, lex.text = tokDMS, text
+	}
+}
+
+// 度分秒のリテラル (30d, 30d15m, 30d15m20.5s など)
+var dmsPattern = regexp.MustCompile(`^(\d+)d(?:(\d+)m)?(?:(\d+(?:\.\d*)?)s)?$`)
+
+// 度分秒のリテラルを度に変換する
+func parseDMS(text string) Value {
+	m := dmsPattern.FindStringSubmatch(text)
+	if m == nil {
+		panic(fmt.Errorf("invalid angle literal: %v", text))
+	}
+	var d, min, sec float64
+	fmt.Sscan(m[1], &d)
+	if m[2] != "" {
+		fmt.Sscan(m[2], &min)
+	}
+	if m[3] != "" {
+		fmt.Sscan(m[3], &sec)
+	}
+	if min >= 60 || sec >= 60 {
+		panic(fmt.Errorf("invalid angle literal: %v", text))
+	}
+	return Value(d + min/60 + sec/3600)
+}
+
+// 度分秒で表示する
+var dms = false
+
+// 度を度分秒で表す (秒は小数点以下 6 桁に丸める)
+func formatDMS(x float64) string {
+	sign := ""
+	if x < 0 {
+		sign, x = "-", -x
+	}
+	t := math.Round(x*3600*1e6) / 1e6
+	d := math.Floor(t / 3600)
+	m := math.Floor((t - d*3600) / 60)
+	sec := math.Round((t-d*3600-m*60)*1e6) / 1e6
+	return fmt.Sprintf("%v%vd%vm%vs", sign, d, m, strconv.FormatFloat(sec, 'f', -1, 64))
+}
+
+// 小数点にコンマを使う (引数の区切りは ; になる)
+var decimalComma = false
+
+// 引数の区切り
+func argSep() rune {
+	if decimalComma {
+		return ';'
+	}
+	return ','
+}
+
+// 次のトークンを先読みする
+func (lex *Lex) peekToken() rune {
+	if !lex.ahead {
+		tok, text, pos := lex.Token, lex.text, lex.pos
+		lex.getToken()
+		lex.aheadTok, lex.aheadText, lex.aheadPos = lex.Token, lex.text, lex.pos
+		lex.Token, lex.text, lex.pos = tok, text, pos
+		lex.ahead = true
+	}
+	return lex.aheadTok
+}
+
+// エラーのあと文または行の残りを読み飛ばす
+func (lex *Lex) skipLine() {
+	for lex.Token != ';' && lex.Token != '\n' && lex.Token != scanner.EOF {
+		if lex.ahead {
+			lex.Token, lex.text, lex.pos = lex.aheadTok, lex.aheadText, lex.aheadPos
+			lex.ahead = false
+		} else {
+			lex.scan()
+		}
+	}
+	lex.ahead = false
+}
+
+// 位置 start から現在のトークンまでの原文
+func (lex *Lex) source(start int) string {
+	return lex.rec.text(start, lex.pos+len(lex.text))
+}
+
+// 直前の文の原文 (edit の対象)
+var lastSource string
+
+// 文の原文を記録し、それより前の入力の記録を捨てる
+func (lex *Lex) record(start int) {
+	if lex.Token == scanner.EOF {
+		return
+	}
+	if start >= 0 {
+		lastSource = strings.TrimSpace(lex.source(start))
+	}
+	lex.rec.drop(lex.pos)
+}
+
+// キーワード引数のない引数の取得 (name = expr は代入式として読む)
+func exprArgs(lex *Lex) []Expr {
+	if lex.Token != '(' {
+		panic(fmt.Errorf("'(' expected"))
+	}
+	lex.getToken()
+	xs := []Expr{expression(lex)}
+	for lex.Token == argSep() {
+		lex.getToken()
+		xs = append(xs, expression(lex))
+	}
+	if lex.Token != ')' {
+		panic(fmt.Errorf("')' expected"))
+	}
+	lex.getToken()
+	return xs
+}
+
+// 引数の取得
+func getArgs(lex *Lex) []Expr {
+	e, kws := getArgsKw(lex)
+	if len(kws) > 0 {
+		panic(fmt.Errorf("keyword arguments not allowed"))
+	}
+	return e
+}
+
+// キーワード引数付きの引数の取得
+// name=expr の形はキーワード引数とし、位置引数のあとに書く。
+// 代入式を引数にするときは (x = 1) のように括弧で囲む。
+func getArgsKw(lex *Lex) ([]Expr, []*Agn) {
+	e := make([]Expr, 0)
+	kws := make([]*Agn, 0)
+	if lex.Token != '(' {
+		panic(fmt.Errorf("'(' expected"))
+	}
+	lex.getToken()
+	if lex.Token == ')' {
+		lex.getToken()
+		return e, kws
+	}
+	for {
+		if lex.Token == scanner.Ident && lex.peekToken() == '=' {
+			name := Variable(lex.text)
+			lex.getToken()
+			lex.getToken()
+			kws = append(kws, newAgn(name, expression(lex)))
+		} else if len(kws) > 0 {
+			panic(fmt.Errorf("positional argument after keyword argument"))
+		} else {
+			e = append(e, expression(lex))
+		}
+		switch lex.Token {
+		case ')':
+			lex.getToken()
+			return e, kws
+		case argSep():
+			lex.getToken()
+		default:
+			panic(fmt.Errorf("unexpected token in argument list"))
+		}
+	}
+}
+
+// 因子
+func factor(lex *Lex) Expr {
+	switch lex.Token {
+	case '(':
+		lex.getToken()
+		e := expression(lex)
+		if lex.Token != ')' {
+			panic(fmt.Errorf("')' expected"))
+		}
+		lex.getToken()
+		return e
+	case tokDMS:
+		v := parseDMS(lex.text)
+		lex.getToken()
+		return v
+	case scanner.Int, scanner.Float:
+		var n float64
+		fmt.Sscan(lex.text, &n)
+		if lex.Token == scanner.Int {
+			checkIntLiteral(lex.text, n)
+		}
+		lex.getToken()
+		return Value(n)
+	case scanner.Ident:
+		name := lex.text
+		lex.getToken()
+		if name == "quit" {
+			panic(name)
+		}
+		if sf, ok := specialTable[name]; ok {
+			return sf(lex)
+		}
+		if tf, ok := tupleTable[name]; ok {
+			return tupleApp(lex, name, tf)
+		}
+		v, ok := funcTable[name]
+		if ok {
+			xs, kws := getArgsKw(lex)
+			xs = bindArgs(name, v, xs, kws)
+			checkArgc(name, v, xs)
+			return newApp(name, v, xs)
+		} else if c, ok := lookupConst(name); ok {
+			if lex.Token == '=' || lex.Token == tokDecl {
+				panic(fmt.Errorf("cannot assign to constant %v", name))
+			}
+			return c
+		} else {
+			return Variable(name)
+		}
+	case scanner.EOF:
+		panic(fmt.Errorf("unexpected end of input"))
+	default:
+		panic(fmt.Errorf("unexpected token: %v", lex.text))
+	}
+}
+
+// 累乗 (^ または **、右結合)
+// 指数には符号を付けられる (2^-1 = 0.5)
+// 後置の ! (階乗) は累乗より強く結合する (2^3! = 2^6)。x!=1 は != と読む。
+func power(lex *Lex) Expr {
+	e := factor(lex)
+	if lex.Token == '!' {
+		checkFactorial(e)
+	}
+	for lex.Token == '!' {
+		lex.getToken()
+		e = newOp1('!', e)
+	}
+	if lex.Token == '^' || lex.Token == tokPow {
+		lex.getToken()
+		return newOp2('^', e, unary(lex))
+	}
+	return e
+}
+
+// 単項の符号
+// 累乗より弱く結合する (-2^2 = -(2^2) = -4)。
+// 項の途中にも書け (3 * -2 = -6)、重ねることもできる (--5 = 5)。
+func unary(lex *Lex) Expr {
+	switch lex.Token {
+	case '+':
+		lex.getToken()
+		return newOp1('+', unary(lex))
+	case '-':
+		lex.getToken()
+		return newOp1('-', unary(lex))
+	case '~':
+		lex.getToken()
+		return newOp1('~', unary(lex))
+	default:
+		return power(lex)
+	}
+}
+
+// 項
+func term(lex *Lex) Expr {
+	e := unary(lex)
+	for {
+		switch lex.Token {
+		case '*':
+			lex.getToken()
+			e = newOp2('*', e, unary(lex))
+		case '/':
+			lex.getToken()
+			e = newOp2('/', e, unary(lex))
+		default:
+			return e
+		}
+	}
+}
+
+// 式
+func expr1(lex *Lex) Expr {
+	e := term(lex)
+	for {
+		switch lex.Token {
+		case '+':
+			lex.getToken()
+			e = newOp2('+', e, term(lex))
+		case '-':
+			lex.getToken()
+			e = newOp2('-', e, term(lex))
+		default:
+			return e
+		}
+	}
+}
+
+// 比較 (真なら 1、偽なら 0)
+func comparison(lex *Lex) Expr {
+	e := expr1(lex)
+	codes := []rune{}
+	xs := []Expr{e}
+	for isComparison(lex.Token) {
+		codes = append(codes, lex.Token)
+		lex.getToken()
+		xs = append(xs, expr1(lex))
+	}
+	switch len(codes) {
+	case 0:
+		return e
+	case 1:
+		return newOp2(codes[0], xs[0], xs[1])
+	default:
+		return newChain(codes, xs)
+	}
+}
+
+func isComparison(t rune) bool {
+	switch t {
+	case '<', '>', tokLe, tokGe, tokEq, tokNe:
+		return true
+	}
+	return false
+}
+
+// 既定値 (x ?: y は x が未定義の変数を含むか NaN なら y、右結合)
+func elvis(lex *Lex) Expr {
+	e := comparison(lex)
+	if lex.Token == tokElvis {
+		lex.getToken()
+		return newForm("?:", []Expr{e, elvis(lex)}, evalElvis)
+	}
+	return e
+}
+
+func evalElvis(xs []Expr) Value {
+	if v, ok := tryEval(xs[0], isUnbound); ok && !math.IsNaN(float64(v)) {
+		return v
+	}
+	return xs[1].Eval()
+}
+
+// 評価して、catch が真となるエラーが起きたら ok を false にする
+func tryEval(e Expr, catch func(error) bool) (v Value, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if err, isErr := r.(error); !isErr || !catch(err) {
+				panic(r)
+			}
+		}
+	}()
+	return e.Eval(), true
+}
+
+func isUnbound(err error) bool {
+	_, ok := err.(unboundError)
+	return ok
+}
+
+func expression(lex *Lex) Expr {
+	e := elvis(lex)
+	if lex.Token == '=' || lex.Token == tokDecl {
+		v, ok := e.(Variable)
+		if ok {
+			decl := lex.Token == tokDecl
+			lex.getToken()
+			if decl {
+				return newDecl(v, expression(lex))
+			}
+			return newAgn(v, expression(lex))
+		} else {
+			panic(fmt.Errorf("invalid assign form"))
+		}
+	}
+	return e
+}
+
+// panic をエラーに変換する (defer で使う)
+func catchError(err *error) {
+	if e := recover(); e != nil {
+		if x, ok := e.(error); ok {
+			*err = x
+		} else {
+			*err = fmt.Errorf("%v", e)
+		}
+	}
+}
+
+// Parse に渡せる文字列の長さの上限 (0 なら制限しない)
+var maxInput = 64 * 1024
+
+// 文字列の式の構文解析 (末尾の ; は省略できる)
+// キャッシュが有効なら同じ文字列に対して同じ構文木を返す。
+func Parse(src string) (e Expr, err error) {
+	if maxInput > 0 && len(src) > maxInput {
+		return nil, fmt.Errorf("input too long: %d bytes exceeds limit %d", len(src), maxInput)
+	}
+	if e, ok := parseCache.get(src); ok {
+		return e, nil
+	}
+	defer catchError(&err)
+	e = parseString(src)
+	parseCache.put(src, e)
+	return e, nil
+}
+
+// キャッシュを使わない構文解析
+func parseString(src string) Expr {
+	lex := newLex(strings.NewReader(src))
+	lex.getToken()
+	e := expression(lex)
+	if lex.Token == ';' {
+		lex.getToken()
+	}
+	if lex.Token != scanner.EOF {
+		panic(fmt.Errorf("invalid expression"))
+	}
+	return e
+}
+
+// 文字列の式の評価
+func EvalString(src string) (v Value, err error) {
+	e, err := Parse(src)
+	if err != nil {
+		return 0, err
+	}
+	defer catchError(&err)
+	beginEval(e)
+	v, _ = evalAtomic(e.Eval)
+	return v, nil
+}
+
+// 構文木を評価して、値か評価のエラーを Result で返す (panic しない)
+// 未束縛の変数、範囲外の代入、maxcost の超過などは Err に入る。
+func EvalResult(e Expr) (r Result) {
+	defer catchError(&r.Err)
+	beginEval(e)
+	r.Value, _ = evalAtomic(e.Eval)
+	return r
+}
+
+// 与えた変数の束縛のもとで構文木を評価する
+// 大域変数は参照も変更もしない。式の中の代入は vars にも反映されない。
+func EvalWith(e Expr, vars map[string]float64) (Value, error) {
+	env := make(map[Variable]Value, len(vars))
+	for name, x := range vars {
+		env[Variable(name)] = Value(x)
+	}
+	return evalIn(env, e)
+}
+
+// env を大域変数の代わりにして構文木を評価する
+func evalIn(env map[Variable]Value, e Expr) (v Value, err error) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	saved := globalEnv
+	globalEnv = env
+	defer func() { globalEnv = saved }()
+	defer catchError(&err)
+	beginEval(e)
+	return e.Eval(), nil
+}
+
+// 大域の状態を入れ替えて評価するときの排他制御
+var stateMu sync.Mutex
+
+// 結果やコマンドの表示の出力先と、警告の出力先 (Session.EvalTo で入れ替える)
+var (
+	output     io.Writer = os.Stdout
+	warnOutput io.Writer = os.Stderr
+)
+
+// 利用者ごとの計算の状態 (変数、関数、定数、モード、表示の設定、スタック、メモリ、結果の履歴)
+// パッケージの大域変数が既定のセッションで、REPL、Parse、EvalString はそれを使う。
+// Session.Eval は評価の間だけ大域変数と中身を入れ替えるので、
+// 既定のセッションの評価と同時に呼んではいけない。
+type Session struct {
+	env          map[Variable]Value
+	funcs        map[string]Func
+	defines      map[string]Value
+	angleMode    string
+	epsilon      float64
+	strictDecl   bool
+	bigMode      bool
+	bigPrec      uint
+	maxDepth     int
+	subdivisions int
+	nanSkip      bool
+	undefZero    bool
+	frozen       map[Variable]bool
+	watched      map[Variable]bool
+	ranges       map[Variable][2]Value
+	precision    int
+	grouping     bool
+	groupSep     string
+	decimalComma bool
+	cache        *exprCache
+	stack        []Value
+	memory       Value
+	results      *ring
+	cursor       int
+	undo         map[Variable]savedVar
+	maxCost      int
+}
+
+// 組み込み関数だけを持ち、モードが既定値の新しいセッション
+func NewSession() *Session {
+	s := defaultModes
+	s.env = make(map[Variable]Value)
+	s.funcs = make(map[string]Func)
+	s.defines = make(map[string]Value)
+	s.frozen = make(map[Variable]bool)
+	s.watched = make(map[Variable]bool)
+	s.ranges = make(map[Variable][2]Value)
+	s.cache = newExprCache(0)
+	s.results = newRing(10)
+	for name, fn := range builtinFuncs {
+		s.funcs[name] = fn
+	}
+	return &s
+}
+
+// 起動時のモード (新しいセッションの既定値)
+var defaultModes = Session{
+	angleMode:    angleMode,
+	epsilon:      epsilon,
+	strictDecl:   strictDecl,
+	bigMode:      bigMode,
+	bigPrec:      bigPrec,
+	maxDepth:     maxDepth,
+	subdivisions: subdivisions,
+	nanSkip:      nanSkip,
+	undefZero:    undefinedZero,
+	precision:    precision,
+	grouping:     grouping,
+	groupSep:     groupSep,
+	decimalComma: decimalComma,
+	maxCost:      maxCost,
+}
+
+// セッションと大域変数の中身を入れ替える (2 回呼ぶと元に戻る)
+func (s *Session) swap() {
+	s.env, globalEnv = globalEnv, s.env
+	s.funcs, funcTable = funcTable, s.funcs
+	s.defines, defineTable = defineTable, s.defines
+	s.angleMode, angleMode = angleMode, s.angleMode
+	s.epsilon, epsilon = epsilon, s.epsilon
+	s.strictDecl, strictDecl = strictDecl, s.strictDecl
+	s.bigMode, bigMode = bigMode, s.bigMode
+	s.bigPrec, bigPrec = bigPrec, s.bigPrec
+	s.maxDepth, maxDepth = maxDepth, s.maxDepth
+	s.subdivisions, subdivisions = subdivisions, s.subdivisions
+	s.nanSkip, nanSkip = nanSkip, s.nanSkip
+	s.undefZero, undefinedZero = undefinedZero, s.undefZero
+	s.frozen, frozenVars = frozenVars, s.frozen
+	s.watched, watchedVars = watchedVars, s.watched
+	s.ranges, rangeTable = rangeTable, s.ranges
+	s.precision, precision = precision, s.precision
+	s.grouping, grouping = grouping, s.grouping
+	s.groupSep, groupSep = groupSep, s.groupSep
+	s.decimalComma, decimalComma = decimalComma, s.decimalComma
+	s.cache, parseCache = parseCache, s.cache
+	s.stack, stack = stack, s.stack
+	s.memory, memory = memory, s.memory
+	s.results, results = results, s.results
+	s.cursor, cursor = cursor, s.cursor
+	s.undo, undoEnv = undoEnv, s.undo
+	s.maxCost, maxCost = maxCost, s.maxCost
+}
+
+// セッションの中で使えるコマンド
+// セッションの状態だけを変えるものに限る。load のようにファイルを読むものや、
+// maxinput、maxcost、cache のようにプロセス全体の設定を変えるものは使えない。
+// push や MR などの表示は EvalTo に渡した出力先に書く。
+var sessionCommands = map[string]bool{
+	"def": true, "define": true, "range": true, "freeze": true, "unfreeze": true,
+	"watch": true, "unwatch": true, "undo": true, "undefined": true, "eps": true,
+	"strictdecl": true, "nanskip": true, "bigfloat": true, "subdiv": true,
+	"precision": true, "grouping": true, "groupsep": true, "decimalsep": true,
+	"push": true, "pop": true, "dup": true, "swap": true, "M": true, "MR": true, "MC": true,
+}
+
+// セッションの中で文を一つ評価する (末尾の ; は省略できる)
+// sessionCommands と角度のモードのコマンドも使え、そのときの値は 0 になる。
+// 式の値は toplevel と同じく ans と結果の履歴に入る。コマンドや table などの表示は標準出力に出す。
+// 入力の長さの上限 (maxinput) はプロセス全体で共通。
+func (s *Session) Eval(src string) (Value, error) {
+	return s.EvalTo(os.Stdout, src)
+}
+
+// Eval と同じだが、表示と警告を w に書く
+func (s *Session) EvalTo(w io.Writer, src string) (_ Value, err error) {
+	if maxInput > 0 && len(src) > maxInput {
+		return 0, fmt.Errorf("input too long: %d bytes exceeds limit %d", len(src), maxInput)
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s.swap()
+	defer s.swap()
+	savedOut, savedWarn := output, warnOutput
+	output, warnOutput = w, w
+	defer func() { output, warnOutput = savedOut, savedWarn }()
+	defer catchError(&err)
+	lex := newLex(strings.NewReader(strings.TrimSuffix(strings.TrimSpace(src), ";") + ";"))
+	lex.getToken()
+	if cmd, ok := command(lex); ok {
+		if _, angle := angleUnits[lex.text]; !angle && !sessionCommands[lex.text] {
+			panic(fmt.Errorf("command not allowed in a session: %v", lex.text))
+		}
+		lex.getToken()
+		cmd(lex)
+		endSession(lex)
+		return 0, nil
+	}
+	e := expression(lex)
+	if lex.Token != ';' {
+		panic(fmt.Errorf("invalid expression"))
+	}
+	endSession(lex)
+	beginEval(e)
+	v, log := evalAtomic(func() Value {
+		if bigMode {
+			f, _ := evalBig(e).Float64()
+			return Value(f)
+		}
+		return e.Eval()
+	})
+	if len(log) > 0 {
+		undoEnv = log
+	}
+	setResult(v)
+	return v, nil
+}
+
+// Session.Eval の文のあとに入力が残っていないことの確認
+func endSession(lex *Lex) {
+	lex.getToken()
+	if lex.Token != scanner.EOF {
+		panic(fmt.Errorf("invalid expression"))
+	}
+}
+
+// HTTP で式を評価するハンドラ
+// POST の本文または ?expr= の式を評価して {"result": 14} か {"error": "..."} を返す。
+// push や table などの表示があれば {"result": 0, "output": "..."} のように output に入れる。
+// calc-session クッキーのセッションで評価する。クッキーがなければ新しいセッションで評価し、
+// そのセッションのクッキーを返す。セッションの評価の手間は handlerMaxCost までに制限する。
+func Handler() http.Handler {
+	return http.HandlerFunc(serveEval)
+}
+
+// HTTP のセッション
+type httpSess struct {
+	*Session
+	client string    // 作ったクライアントのアドレス
+	used   time.Time // 最後に使った時刻
+}
+
+var (
+	sessionMu sync.Mutex
+	sessions  = make(map[string]*httpSess)
+)
+
+const (
+	// 保持するセッションの上限
+	// 超えたら使われていないセッションのうち最も前に使ったものを捨てる。
+	maxSessions = 1000
+	// クライアントごとのセッションの上限 (超えたらそのクライアントの最も前に使ったものを捨てる)
+	maxClientSessions = 10
+	// この時間使われていないセッションは他のクライアントのために捨ててよい
+	sessionIdle = 10 * time.Minute
+	// HTTP のセッションの評価の手間の上限 (maxcost)
+	handlerMaxCost = 1000000
+)
+
+func serveEval(w http.ResponseWriter, r *http.Request) {
+	src := r.URL.Query().Get("expr")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if maxInput > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, int64(maxInput))
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		if len(body) > 0 {
+			src = string(body)
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "method not allowed"})
+		return
+	}
+	s, err := httpSession(w, r)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	var out bytes.Buffer
+	v, err := s.EvalTo(&out, src)
+	if err == nil && (math.IsNaN(float64(v)) || math.IsInf(float64(v), 0)) {
+		err = fmt.Errorf("result is not finite: %v", v)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	body := map[string]interface{}{"result": v}
+	if out.Len() > 0 {
+		body["output"] = out.String()
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// クッキーのセッション (なければ新しいセッションを作る)
+func httpSession(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	now := time.Now()
+	if c, err := r.Cookie("calc-session"); err == nil {
+		if s, ok := sessions[c.Value]; ok {
+			s.used = now
+			return s.Session, nil
+		}
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if id, n := oldestSession(func(s *httpSess) bool { return s.client == client }); n >= maxClientSessions {
+		delete(sessions, id)
+	} else if len(sessions) >= maxSessions {
+		id, n := oldestSession(func(s *httpSess) bool { return now.Sub(s.used) >= sessionIdle })
+		if n == 0 {
+			return nil, fmt.Errorf("too many sessions")
+		}
+		delete(sessions, id)
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	id := hex.EncodeToString(buf)
+	s := NewSession()
+	s.maxCost = handlerMaxCost
+	sessions[id] = &httpSess{s, client, now}
+	http.SetCookie(w, &http.Cookie{Name: "calc-session", Value: id, Path: "/", HttpOnly: true})
+	return s, nil
+}
+
+// ok を満たすセッションのうち最も前に使ったものの ID と、ok を満たすセッションの数
+func oldestSession(ok func(*httpSess) bool) (id string, n int) {
+	var oldest time.Time
+	for k, s := range sessions {
+		if !ok(s) {
+			continue
+		}
+		if n == 0 || s.used.Before(oldest) {
+			id, oldest = k, s.used
+		}
+		n++
+	}
+	return id, n
+}
+
+// body を JSON で返す
+func writeJSON(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// EvalStream が送る評価結果
+type Result struct {
+	Value Value
+	Err   error
+}
+
+// r から ; で区切った式を順に読んで評価し、結果を results に送る
+// 式ごとのエラーは Err に入れて送り、次の式に進む。EOF で results を閉じる。
+// 文の解析と評価は stateMu を取って行うが、r の読み込みを待つ間と結果を送る間は外す。
+func EvalStream(r io.Reader, results chan<- Result) {
+	defer close(results)
+	lex := newLex(unlockedReader{r})
+	for {
+		stateMu.Lock()
+		lex.getToken()
+		if lex.Token == scanner.EOF {
+			stateMu.Unlock()
+			return
+		}
+		v, err := evalStatement(lex)
+		if err != nil {
+			for lex.Token != ';' && lex.Token != scanner.EOF {
+				lex.getToken()
+			}
+		}
+		// 評価した文の入力の記録は要らない
+		lex.rec.drop(lex.pos)
+		stateMu.Unlock()
+		results <- Result{v, err}
+	}
+}
+
+// 読み込みを待つ間は stateMu を外す Reader (stateMu を取った状態で使う)
+type unlockedReader struct {
+	r io.Reader
+}
+
+func (u unlockedReader) Read(p []byte) (int, error) {
+	stateMu.Unlock()
+	defer stateMu.Lock()
+	return u.r.Read(p)
+}
+
+// ; で区切った式をすべて評価して結果を返す
+// 最初のエラーで止め、それまでの結果とエラーを返す。
+func EvalAll(input string) ([]Value, error) {
+	if maxInput > 0 && len(input) > maxInput {
+		return nil, fmt.Errorf("input too long: %d bytes exceeds limit %d", len(input), maxInput)
+	}
+	var vs []Value
+	lex := newLex(strings.NewReader(input))
+	for {
+		lex.getToken()
+		if lex.Token == scanner.EOF {
+			return vs, nil
+		}
+		v, err := evalStatement(lex)
+		if err != nil {
+			return vs, err
+		}
+		vs = append(vs, v)
+	}
+}
+
+// ; で終わる式を一つ評価する (入力の最後の式の ; は省略できる)
+func evalStatement(lex *Lex) (v Value, err error) {
+	defer catchError(&err)
+	e := expression(lex)
+	if lex.Token != ';' && lex.Token != scanner.EOF {
+		panic(fmt.Errorf("';' expected"))
+	}
+	beginEval(e)
+	v, _ = evalAtomic(e.Eval)
+	return v, nil
+}
+
+// 構文木のキャッシュ (LRU, size が 0 なら無効)
+// 構文木は関数の定義などに依存するので def で消去する。
+// キャッシュした構文木は共有されるので、書き換えるときは複製すること。
+type exprCache struct {
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	src  string
+	expr Expr
+}
+
+var parseCache = newExprCache(0)
+
+func newExprCache(size int) *exprCache {
+	return &exprCache{size, list.New(), make(map[string]*list.Element)}
+}
+
+func (c *exprCache) get(src string) (Expr, bool) {
+	el, ok := c.items[src]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry).expr, true
+}
+
+func (c *exprCache) put(src string, e Expr) {
+	if c.size <= 0 {
+		return
+	}
+	if el, ok := c.items[src]; ok {
+		el.Value.(*cacheEntry).expr = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[src] = c.ll.PushFront(&cacheEntry{src, e})
+	c.trim()
+}
+
+// size を超えた古い項目を捨てる
+func (c *exprCache) trim() {
+	for c.ll.Len() > c.size {
+		el := c.ll.Back()
+		delete(c.items, el.Value.(*cacheEntry).src)
+		c.ll.Remove(el)
+	}
+}
+
+func (c *exprCache) clear() {
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// big.Float による評価の設定
+var bigMode = false
+var bigPrec uint = 256
+
+// big.Float による評価
+// 四則演算、整数の累乗、sqrt は big.Float で計算し、
+// それ以外は float64 で評価して精度が落ちることを警告する。
+// 変数には float64 で格納する。
+func evalBig(e Expr) *big.Float {
+	switch x := e.(type) {
+	case Value:
+		return toBig(x)
+	case *Op1:
+		countOp()
+		v := evalBig(x.expr)
+		switch x.code {
+		case '-':
+			v.Neg(v)
+		case '!':
+			// 階乗は整数として正確に計算する
+			// 手間は n log n 程度なので引数の大きさに合わせて数える
+			f, _ := v.Float64()
+			k := factorialArg(Value(f))
+			countOps(int(k) * bits.Len64(uint64(k)))
+			n := bigFactorial(Value(f))
+			v = new(big.Float).SetPrec(max(bigPrec, uint(n.BitLen()))).SetInt(n)
+		case '~':
+			// ^n = -n-1 を整数として計算する
+			if !v.IsInt() || v.IsInf() {
+				panic(fmt.Errorf("bitwise not of non-integer: %v", formatBig(v)))
+			}
+			n, _ := v.Int(nil)
+			n.Not(n)
+			v = new(big.Float).SetPrec(max(bigPrec, uint(n.BitLen()))).SetInt(n)
+		}
+		return v
+	case *Op2:
+		countOp()
+		a := evalBig(x.left)
+		b := evalBig(x.right)
+		v := new(big.Float).SetPrec(bigPrec)
+		switch x.code {
+		case '+':
+			return v.Add(a, b)
+		case '-':
+			return v.Sub(a, b)
+		case '*':
+			return v.Mul(a, b)
+		case '/':
+			return v.Quo(a, b)
+		case '^':
+			if b.IsInt() && !b.IsInf() {
+				if n, acc := b.Int64(); acc == big.Exact {
+					// 掛け算の回数は指数のビット数の 2 倍まで
+					countOps(2 * bits.Len64(uint64(max(n, -n))))
+					return bigPow(a, n)
+				}
+			}
+		case '<', '>', tokLe, tokGe, tokEq, tokNe:
+			c := a.Cmp(b)
+			if compare(x.code, Value(c), 0) {
+				return v.SetInt64(1)
+			}
+			return v.SetInt64(0)
+		}
+		warnFloat64(string(x.code))
+		a64, _ := a.Float64()
+		b64, _ := b.Float64()
+		return toBig(newOp2(x.code, Value(a64), Value(b64)).Eval())
+	case *Agn:
+		v := evalBig(x.expr)
+		f, _ := v.Float64()
+		(&Agn{x.name, Value(f), x.decl}).Eval()
+		return v
+	case *App:
+		if _, ok := x.fn.(Func1); ok && x.name == "sqrt" {
+			v := evalBig(x.xs[0])
+			if v.Sign() < 0 {
+				return toBig(Value(math.NaN()))
+			}
+			return v.Sqrt(v)
+		}
+		warnFloat64(x.name)
+		return toBig(x.Eval())
+	case Variable:
+		return toBig(x.Eval())
+	default:
+		warnFloat64("expression")
+		return toBig(e.Eval())
+	}
+}
+
+// float64 から big.Float への変換
+// 最短の10進表記を経由するので 0.1 などのリテラルは10進のまま精度を上げる。
+func toBig(v Value) *big.Float {
+	x := float64(v)
+	if math.IsNaN(x) {
+		panic(fmt.Errorf("bigfloat: NaN is not representable"))
+	}
+	f, _, err := big.ParseFloat(strconv.FormatFloat(x, 'g', -1, 64), 10, bigPrec, big.ToNearestEven)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// a の n 乗 (n は整数)
+func bigPow(a *big.Float, n int64) *big.Float {
+	r := new(big.Float).SetPrec(bigPrec).SetInt64(1)
+	p := new(big.Float).SetPrec(bigPrec).Set(a)
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			r.Mul(r, p)
+		}
+		p.Mul(p, p)
+	}
+	if neg {
+		r.Quo(new(big.Float).SetPrec(bigPrec).SetInt64(1), r)
+	}
+	return r
+}
+
+// float64 で正確に表せない整数リテラルを警告する (2^53 を超えると起こりうる)
+func checkIntLiteral(text string, n float64) {
+	if math.Abs(n) < 1<<53 {
+		return
+	}
+	b, ok := new(big.Int).SetString(text, 0)
+	if !ok {
+		return
+	}
+	if c, _ := new(big.Float).SetFloat64(n).Int(nil); c.Cmp(b) != 0 {
+		fmt.Fprintf(warnOutput, "warning: integer literal %v is not exact in float64 (%v)\n", text, c)
+	}
+}
+
+func warnFloat64(name string) {
+	fmt.Fprintf(warnOutput, "warning: %v evaluated in float64 (precision loss)\n", name)
+}
+
+// big.Float の表示
+// 精度の範囲で正確な整数は指数を使わずに表示する
+func formatBig(v *big.Float) string {
+	if precision >= 0 {
+		return v.Text('f', precision)
+	} else if v.IsInt() && v.MantExp(nil) <= int(v.Prec()) {
+		return v.Text('f', 0)
+	}
+	return v.Text('g', -1)
+}
+
+// 部分式 (評価の順)
+func children(e Expr) []Expr {
+	switch x := e.(type) {
+	case *Op1:
+		return []Expr{x.expr}
+	case *Op2:
+		return []Expr{x.left, x.right}
+	case *Agn:
+		return []Expr{x.expr}
+	case *App:
+		return x.xs
+	case *Form:
+		return x.xs
+	case *Chain:
+		return x.xs
+	default:
+		return nil
+	}
+}
+
+// 構文木を部分式から先に (評価の順に) たどる
+func walk(e Expr, fn func(Expr)) {
+	for _, x := range children(e) {
+		if x != nil {
+			walk(x, fn)
+		}
+	}
+	fn(e)
+}
+
+// 構文木の構造のハッシュ値
+// 同じ形の構文木 (ノードの種類、演算子、名前、値、特殊形式の文字列の引数、部分式が等しい) は同じ値になる。
+// hashExpr が書き出す文字列は構造そのものを表すので、完全な比較にも使える。
+func Hash(e Expr) uint64 {
+	h := fnv.New64a()
+	hashExpr(h, e)
+	return h.Sum64()
+}
+
+func hashExpr(w io.Writer, e Expr) {
+	io.WriteString(w, nodeLabel(e))
+	for _, x := range children(e) {
+		hashExpr(w, x)
+	}
+}
+
+// 子を除いた節だけの hashExpr の文字列
+func nodeLabel(e Expr) string {
+	var label interface{}
+	switch x := e.(type) {
+	case Value:
+		label = math.Float64bits(float64(x))
+	case Variable:
+		label = string(x)
+	case EvalStr:
+		label = string(x)
+	case *Op1:
+		label = x.code
+	case *Op2:
+		label = x.code
+	case *Chain:
+		label = x.codes
+	case *Agn:
+		label = fmt.Sprint(x.name, x.decl)
+	case *App:
+		label = x.name
+	case *Form:
+		label = fmt.Sprintf("%v %q", x.name, x.lits)
+	}
+	return fmt.Sprintf("%T %q %d;", e, fmt.Sprint(label), len(children(e)))
+}
+
+// 同じ形の部分式を一度だけ評価する (共通部分式の除去)
+// 代入、特殊形式、ユーザ定義関数、副作用のある組み込み関数を含む式では
+// 評価の順序で結果が変わりうるので、そのまま評価する。
+// 部分式をまとめた構文木は元の構文木ごとに覚えておき、同じ構文木を評価し直すときに使い回す。
+func EvalCSE(e Expr) (v Value, err error) {
+	defer catchError(&err)
+	beginEval(e)
+	x, ok := cseCache[e]
+	if !ok {
+		x = e
+		if pure(e) {
+			x, _ = share(e, make(map[uint64][]*Memo))
+		}
+		if len(cseCache) >= cseCacheSize {
+			cseCache = make(map[Expr]Expr)
+		}
+		cseCache[e] = x
+	}
+	cseEpoch++
+	v, _ = evalAtomic(x.Eval)
+	return v, nil
+}
+
+// EvalCSE が部分式をまとめた構文木 (元の構文木をキーにする)
+// 上限を超えたらすべて捨てる。
+var cseCache = make(map[Expr]Expr)
+
+const cseCacheSize = 1000
+
+// EvalCSE の評価の回数 (Memo が覚えた値がどの評価のものか)
+var cseEpoch uint64
+
+// 副作用がなく、評価の順序によらない式か
+func pure(e Expr) bool {
+	ok := true
+	walk(e, func(x Expr) {
+		switch y := x.(type) {
+		case *Agn, *Form, EvalStr:
+			ok = false
+		case *App:
+			if _, user := y.fn.(*UserFunc); user || impureFuncs[y.name] {
+				ok = false
+			}
+		}
+	})
+	return ok
+}
+
+// 表示や代入などの副作用のある組み込み関数
+// (defined のような特殊形式は pure がすべて除く)
+var impureFuncs = map[string]bool{"base": true, "incr": true, "decr": true}
+
+// 一度だけ評価して値を覚えておく部分式
+// 覚えた値は同じ EvalCSE の評価の中でだけ使う。
+type Memo struct {
+	expr  Expr
+	epoch uint64
+	val   Value
+}
+
+func (m *Memo) Eval() Value {
+	if m.epoch != cseEpoch {
+		m.val = m.expr.Eval()
+		m.epoch = cseEpoch
+	}
+	return m.val
+}
+
+// 同じ形の部分式を一つの Memo にまとめた構文木を作る (元の構文木は変更しない)
+// 部分式のハッシュ値も返す。子を先にまとめるので、同じ形の節は
+// 子が同じもの (同じ Memo か等しい葉) になり、節の比較は子をたどり直さずに済む。
+func share(e Expr, memo map[uint64][]*Memo) (Expr, uint64) {
+	var x Expr
+	var h uint64
+	switch y := e.(type) {
+	case *Op1:
+		var a Expr
+		a, h = share(y.expr, memo)
+		x = newOp1(y.code, a)
+		h = mixHash(h, uint64(y.code))
+	case *Op2:
+		xs, hs := shareAll([]Expr{y.left, y.right}, memo)
+		x = newOp2(y.code, xs[0], xs[1])
+		h = mixHash(hs, uint64(y.code))
+	case *Chain:
+		var xs []Expr
+		xs, h = shareAll(y.xs, memo)
+		x = newChain(y.codes, xs)
+		for _, c := range y.codes {
+			h = mixHash(h, uint64(c))
+		}
+	case *App:
+		var xs []Expr
+		xs, h = shareAll(y.xs, memo)
+		x = newApp(y.name, y.fn, xs)
+		h = mixHash(h, Hash(Variable(y.name)))
+	default:
+		return e, Hash(e)
+	}
+	for _, m := range memo[h] {
+		if sameNode(m.expr, x) {
+			return m, h
+		}
+	}
+	m := &Memo{expr: x}
+	memo[h] = append(memo[h], m)
+	return m, h
+}
+
+func shareAll(xs []Expr, memo map[uint64][]*Memo) ([]Expr, uint64) {
+	ys := make([]Expr, len(xs))
+	h := uint64(len(xs))
+	for i, x := range xs {
+		y, hx := share(x, memo)
+		ys[i] = y
+		h = mixHash(h, hx)
+	}
+	return ys, h
+}
+
+// ハッシュ値に x を混ぜる
+func mixHash(h, x uint64) uint64 {
+	return (h^x)*1099511628211 + 0x9e3779b97f4a7c15
+}
+
+// share で作った節 a と b が同じ形か (子は share がまとめたものなので同一性で比べる)
+func sameNode(a, b Expr) bool {
+	switch x := a.(type) {
+	case *Op1:
+		y, ok := b.(*Op1)
+		return ok && x.code == y.code && sameChild(x.expr, y.expr)
+	case *Op2:
+		y, ok := b.(*Op2)
+		return ok && x.code == y.code && sameChild(x.left, y.left) && sameChild(x.right, y.right)
+	case *Chain:
+		y, ok := b.(*Chain)
+		return ok && string(x.codes) == string(y.codes) && sameChildren(x.xs, y.xs)
+	case *App:
+		y, ok := b.(*App)
+		return ok && x.name == y.name && sameChildren(x.xs, y.xs)
+	}
+	return false
+}
+
+func sameChildren(xs, ys []Expr) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if !sameChild(xs[i], ys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 値は -0 と 0 を区別して比べる
+func sameChild(a, b Expr) bool {
+	if x, ok := a.(Value); ok {
+		y, ok := b.(Value)
+		return ok && math.Float64bits(float64(x)) == math.Float64bits(float64(y))
+	}
+	return a == b
+}
+
+// 定数の部分式を評価して値に置き換えた構文木 (元の構文木は変更しない)
+// 変数を含む部分式や副作用のある式はそのまま残す。
+func Fold(e Expr) Expr {
+	var x Expr
+	switch y := e.(type) {
+	case *Op1:
+		x = newOp1(y.code, Fold(y.expr))
+	case *Op2:
+		x = newOp2(y.code, Fold(y.left), Fold(y.right))
+	case *Chain:
+		x = newChain(y.codes, foldAll(y.xs))
+	case *App:
+		x = newApp(y.name, y.fn, foldAll(y.xs))
+	case *Agn:
+		return &Agn{y.name, Fold(y.expr), y.decl}
+	case *Form:
+		f := newForm(y.name, foldAll(y.xs), y.fn)
+		f.lits = y.lits
+		return f
+	default:
+		return e
+	}
+	for _, c := range children(x) {
+		if _, ok := c.(Value); !ok {
+			return x
+		}
+	}
+	if !pure(x) {
+		return x
+	}
+	return x.Eval()
+}
+
+func foldAll(xs []Expr) []Expr {
+	ys := make([]Expr, len(xs))
+	for i, x := range xs {
+		if x != nil {
+			ys[i] = Fold(x)
+		}
+	}
+	return ys
+}
+
+// 評価の手間の見積もり
+// 定数や演算は 1、組み込み関数は 10、ユーザ定義関数は 100 とし、
+// 本体を繰り返し評価する特殊形式は本体の手間に回数を掛ける。
+func Cost(e Expr) int {
+	c := 1
+	xs := children(e)
+	switch x := e.(type) {
+	case *App:
+		if _, ok := x.fn.(*UserFunc); ok {
+			c = 100
+		} else {
+			c = 10
+		}
+	case *Form:
+		if reps, ok := formReps[x.name]; ok {
+			c += reps(x.xs) * Cost(x.xs[0])
+			xs = xs[1:]
+		}
+	}
+	for _, y := range xs {
+		if y != nil {
+			c += Cost(y)
+		}
+	}
+	return c
+}
+
+// 特殊形式が本体を評価する回数の見積もり
+var formReps = map[string]func([]Expr) int{
+	"solve":     func(xs []Expr) int { return 300 },
+	"integrate": func(xs []Expr) int { return subdivisions + 1 },
+	"plot":      func(xs []Expr) int { return plotWidth },
+	"table":     func(xs []Expr) int { return constSteps(xs[2], xs[3], xs[4]) },
+	"repeat":    repeatCount,
+}
+
+// 回数が定数ならその回数、そうでなければ 1000 とする
+// 実際の回数が多すぎれば評価中に countOp で止まる。
+func repeatCount(xs []Expr) int {
+	if n, ok := xs[1].(Value); ok && n >= 0 {
+		return int(math.Min(float64(n), math.MaxInt32))
+	}
+	return 1000
+}
+
+// 範囲が定数なら点の数、そうでなければ 1000 とする
+// 実際の点の数が多すぎれば評価中に countOp で止まる。
+func constSteps(lo, hi, step Expr) int {
+	l, ok1 := lo.(Value)
+	h, ok2 := hi.(Value)
+	s, ok3 := step.(Value)
+	if ok1 && ok2 && ok3 && s != 0 && (h-l)/s >= 0 {
+		return steps(float64(l), float64(h), float64(s))
+	}
+	return 1000
+}
+
+// 評価の手間の上限 (0 なら制限しない)
+var maxCost = 0
+
+// 文の評価を始める (手間を見積もって確かめ、演算の回数を数え直す)
+func beginEval(e Expr) {
+	checkCost(e)
+	opCount = 0
+}
+
+// 手間が上限を超える式を評価前に拒否する
+func checkCost(e Expr) {
+	if maxCost > 0 {
+		if c := Cost(e); c > maxCost {
+			panic(fmt.Errorf("expression too expensive: cost %d exceeds maxcost %d", c, maxCost))
+		}
+	}
+}
+
+// 代入したあと参照されない変数の検出
+// 文の並びを評価の順にたどり、次の代入までに参照されなかった代入を報告する。
+// 呼び出すユーザ定義関数の本体と eval の文字列の中で読む変数も参照とみなす。
+// eval の文字列が構文解析できなければ、何を読むか分からないのでそこまでの代入は報告しない。
+func lint(stmts []Expr) []string {
+	var warns []string
+	pending := make(map[Variable]bool)
+	var order []Variable
+	calling := make(map[*UserFunc]bool) // 本体をたどっている関数 (再帰呼び出しで止める)
+	var scan func(e Expr, f *UserFunc)
+	scan = func(e Expr, f *UserFunc) {
+		walk(e, func(e Expr) {
+			switch x := e.(type) {
+			case Variable:
+				if f == nil || !isParam(f, x) {
+					delete(pending, x)
+				}
+			case *Agn:
+				if f != nil {
+					return
+				}
+				if pending[x.name] {
+					warns = append(warns, fmt.Sprintf("variable %v assigned but never used before reassignment", x.name))
+				}
+				pending[x.name] = true
+				order = append(order, x.name)
+			case *App:
+				if g, ok := x.fn.(*UserFunc); ok && !calling[g] {
+					calling[g] = true
+					for _, d := range g.defaults {
+						if d != nil {
+							scan(d, g)
+						}
+					}
+					scan(g.body, g)
+					calling[g] = false
+				}
+			case EvalStr:
+				if e, err := Parse(string(x)); err == nil {
+					scan(e, f)
+				} else {
+					clear(pending)
+				}
+			}
+		})
+	}
+	for _, stmt := range stmts {
+		scan(stmt, nil)
+	}
+	for _, v := range order {
+		if pending[v] {
+			warns = append(warns, fmt.Sprintf("variable %v assigned but never used", v))
+			delete(pending, v)
+		}
+	}
+	return warns
+}
+
+// v が f の仮引数か
+func isParam(f *UserFunc, v Variable) bool {
+	for _, p := range f.params {
+		if p == v {
+			return true
+		}
+	}
+	return false
+}
+
+// コマンド (文の先頭の識別子で始まり ; で終わる)
+var cmdTable = make(map[string]func(*Lex))
+
+func initCommand() {
+	cmdTable["def"] = cmdDef
+	cmdTable["define"] = cmdDefine
+	cmdTable["range"] = cmdRange
+	cmdTable["freeze"] = cmdFreeze
+	cmdTable["unfreeze"] = cmdUnfreeze
+	cmdTable["watch"] = cmdWatch
+	cmdTable["unwatch"] = cmdUnwatch
+	cmdTable["stats"] = func(lex *Lex) { endStatement(lex); fmt.Fprintln(output, "operations:", lastOps) }
+	cmdTable["quietassign"] = func(lex *Lex) { setOnOff(lex, &quietAssign) }
+	cmdTable["echo"] = func(lex *Lex) { setOnOff(lex, &echo) }
+	cmdTable["undo"] = cmdUndo
+	cmdTable["cse"] = func(lex *Lex) { setOnOff(lex, &cse) }
+	cmdTable["tokens"] = cmdTokens
+	cmdTable["profile"] = cmdProfile
+	cmdTable["tree"] = cmdTree
+	cmdTable["fold"] = func(lex *Lex) { e := expression(lex); endStatement(lex); printTree(Fold(e), 0) }
+	cmdTable["exact"] = cmdExact
+	cmdTable["nanskip"] = func(lex *Lex) { setOnOff(lex, &nanSkip) }
+	cmdTable["compare"] = cmdCompare
+	cmdTable["bits"] = cmdBits
+	cmdTable["env"] = cmdEnv
+	cmdTable["whoami"] = cmdEnv
+	cmdTable["maxdepth"] = cmdMaxDepth
+	cmdTable["edit"] = cmdEdit
+	cmdTable["eps"] = cmdEps
+	cmdTable["strictdecl"] = func(lex *Lex) { setOnOff(lex, &strictDecl) }
+	cmdTable["undefined"] = cmdUndefined
+	cmdTable["precision"] = cmdPrecision
+	cmdTable["grouping"] = func(lex *Lex) { setOnOff(lex, &grouping) }
+	cmdTable["siprefix"] = func(lex *Lex) { setOnOff(lex, &siPrefix) }
+	cmdTable["dms"] = func(lex *Lex) { setOnOff(lex, &dms) }
+	cmdTable["groupsep"] = cmdGroupSep
+	cmdTable["push"] = cmdPush
+	cmdTable["pop"] = stackCommand(1, func(xs []Value) []Value { return nil })
+	cmdTable["dup"] = stackCommand(1, func(xs []Value) []Value { return []Value{xs[0], xs[0]} })
+	cmdTable["swap"] = stackCommand(2, func(xs []Value) []Value { return []Value{xs[1], xs[0]} })
+	cmdTable["peek"] = stackCommand(0, func(xs []Value) []Value { return nil })
+	cmdTable["M"] = cmdMemory
+	cmdTable["MR"] = cmdMemoryRecall
+	cmdTable["MC"] = cmdMemoryClear
+	cmdTable["cache"] = cmdCache
+	cmdTable["bigfloat"] = func(lex *Lex) { setOnOff(lex, &bigMode) }
+	cmdTable["bigprec"] = cmdBigPrec
+	cmdTable["subdiv"] = cmdSubdiv
+	cmdTable["plotsize"] = cmdPlotSize
+	cmdTable["tablewidth"] = cmdTableWidth
+	cmdTable["histogram"] = cmdHistogram
+	cmdTable["binwidth"] = cmdBinWidth
+	cmdTable["currencyfmt"] = cmdCurrencyFmt
+	cmdTable["decimalsep"] = cmdDecimalSep
+	cmdTable["load"] = cmdLoad
+	cmdTable["lint"] = func(lex *Lex) { setOnOff(lex, &lintMode) }
+	cmdTable["maxcost"] = cmdMaxCost
+	cmdTable["maxinput"] = cmdMaxInput
+	cmdTable["last"] = cmdLast
+	cmdTable["lastsize"] = cmdLastSize
+	cmdTable["prev"] = moveCursor(1)
+	cmdTable["next"] = moveCursor(-1)
+	cmdTable["angle"] = func(lex *Lex) { endStatement(lex); fmt.Fprintln(output, angleMode) }
+	for mode := range angleUnits {
+		cmdTable[mode] = setAngleMode(mode)
+	}
+}
+
+// 文の先頭の識別子のコマンド
+// 直後が = か := なら同じ名前の変数への代入として読むので、コマンドにはしない (M = 5;)。
+// M は空白をはさまずに + か - が続くときだけコマンドにする (M + 1; は変数 M の式)。
+func command(lex *Lex) (func(*Lex), bool) {
+	cmd, ok := cmdTable[lex.text]
+	if !ok || lex.Token != scanner.Ident {
+		return nil, false
+	}
+	t := lex.peekToken()
+	if t == '=' || t == tokDecl {
+		return nil, false
+	}
+	if lex.text == "M" && (t != '+' && t != '-' || lex.aheadPos != lex.pos+len(lex.text)) {
+		return nil, false
+	}
+	return cmd, true
+}
+
+// 文の終わりの確認
+func endStatement(lex *Lex) {
+	if lex.Token != ';' {
+		panic(fmt.Errorf("';' expected"))
+	}
+}
+
+// on/off の切り替え (引数がなければ現在の状態を表示する)
+func setOnOff(lex *Lex, flag *bool) {
+	if lex.Token == ';' {
+		if *flag {
+			fmt.Fprintln(output, "on")
+		} else {
+			fmt.Fprintln(output, "off")
+		}
+		return
+	}
+	var b bool
+	switch lex.text {
+	case "on":
+		b = true
+	case "off":
+		b = false
+	default:
+		panic(fmt.Errorf("'on' or 'off' expected"))
+	}
+	lex.getToken()
+	endStatement(lex)
+	*flag = b
+}
+
+// 束縛されていない変数の扱いの表示と設定
+// undefined; undefined zero; undefined error; (既定)
+func cmdUndefined(lex *Lex) {
+	if lex.Token == ';' {
+		if undefinedZero {
+			fmt.Fprintln(output, "zero")
+		} else {
+			fmt.Fprintln(output, "error")
+		}
+		return
+	}
+	switch lex.text {
+	case "zero":
+		undefinedZero = true
+	case "error":
+		undefinedZero = false
+	default:
+		panic(fmt.Errorf("'zero' or 'error' expected"))
+	}
+	lex.getToken()
+	endStatement(lex)
+}
+
+// 現在の数値の表現と approx の許容誤差の表示
+func cmdExact(lex *Lex) {
+	endStatement(lex)
+	if bigMode {
+		fmt.Fprintf(output, "model: bigfloat (%d bits)\n", bigPrec)
+	} else {
+		fmt.Fprintln(output, "model: float64")
+	}
+	fmt.Fprintln(output, "epsilon:", epsilon)
+}
+
+// 計算値と期待値の誤差の表示
+// compare(sqrt(2)^2, 2);
+func cmdCompare(lex *Lex) {
+	xs := getArgs(lex)
+	endStatement(lex)
+	if len(xs) != 2 {
+		panic(argcError("compare", 2, 2, len(xs)))
+	}
+	actual, expected := xs[0].Eval(), xs[1].Eval()
+	abs := math.Abs(float64(actual - expected))
+	fmt.Fprintln(output, "absolute error:", abs)
+	if expected == 0 {
+		fmt.Fprintln(output, "relative error: undefined")
+	} else {
+		fmt.Fprintln(output, "relative error:", abs/math.Abs(float64(expected)))
+	}
+}
+
+// histogram の階級の幅 (0 なら同じ値ごとに数える)
+var binWidth = 0.0
+
+// 値の度数の棒グラフの表示
+// 棒の長さが plotWidth を超えるときは縮める。
+// histogram(1, 2, 2, 3, 3, 3);
+func cmdHistogram(lex *Lex) {
+	xs := getArgs(lex)
+	endStatement(lex)
+	if len(xs) == 0 {
+		panic(argcError("histogram", 1, -1, 0))
+	}
+	counts := make(map[float64]int)
+	for _, x := range xs {
+		v := float64(x.Eval())
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			panic(fmt.Errorf("histogram: not a finite value: %v", v))
+		}
+		if binWidth > 0 {
+			v = binIndex(v)
+		}
+		counts[v]++
+	}
+	keys := make([]float64, 0, len(counts))
+	most := 0
+	for k, n := range counts {
+		keys = append(keys, k)
+		most = max(most, n)
+	}
+	sort.Float64s(keys)
+	rows := make([][]string, len(keys))
+	for i, k := range keys {
+		label := formatValue(Value(k))
+		if binWidth > 0 {
+			label = fmt.Sprintf("[%v, %v)", binEdge(k), binEdge(k+1))
+		}
+		rows[i] = []string{label, strconv.Itoa(counts[k])}
+	}
+	w := [2]int{}
+	for _, row := range rows {
+		for j, c := range row {
+			w[j] = max(w[j], utf8.RuneCountInString(c))
+		}
+	}
+	for i, k := range keys {
+		bar := counts[k]
+		if most > plotWidth {
+			bar = (bar*plotWidth + most - 1) / most
+		}
+		fmt.Fprintf(output, "%-*s  %*s  %v\n", w[0], rows[i][0], w[1], rows[i][1], strings.Repeat("#", bar))
+	}
+}
+
+// v が入る階級の番号 (v / binWidth の整数部)
+// 0.3 / 0.1 = 2.9999999999999996 のような割り算の誤差は整数に丸めて 3 とする。
+func binIndex(v float64) float64 {
+	q := v / binWidth
+	if r := math.Round(q); math.Abs(q-r) <= 1e-9*math.Max(1, math.Abs(q)) {
+		return r
+	}
+	return math.Floor(q)
+}
+
+// k 番目の階級の下端 (k*binWidth の誤差を 15 桁に丸めて表示する)
+func binEdge(k float64) string {
+	return formatValue(Value(sigfig(k*binWidth, 15)))
+}
+
+// histogram の階級の幅の表示と設定
+// binwidth; binwidth 0.5;
+func cmdBinWidth(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, binWidth)
+		return
+	}
+	w := expression(lex)
+	endStatement(lex)
+	width := float64(w.Eval())
+	if !(width >= 0) || math.IsInf(width, 0) {
+		panic(fmt.Errorf("binwidth must be a non-negative number"))
+	}
+	binWidth = width
+}
+
+// currency の通貨記号と桁数の表示と設定
+// currencyfmt; currencyfmt "€" 2;
+func cmdCurrencyFmt(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintf(output, "%q %v\n", currencySymbol, currencyDigits)
+		return
+	}
+	sym := getString(lex)
+	d := expression(lex)
+	endStatement(lex)
+	digits := float64(d.Eval())
+	if digits < 0 || digits > 20 || digits != math.Trunc(digits) {
+		panic(fmt.Errorf("currencyfmt: digits must be an integer from 0 to 20"))
+	}
+	currencySymbol, currencyDigits = sym, int(digits)
+}
+
+// float64 の IEEE 754 の表現の表示
+// bits(3.14);
+func cmdBits(lex *Lex) {
+	xs := getArgs(lex)
+	endStatement(lex)
+	if len(xs) != 1 {
+		panic(argcError("bits", 1, 1, len(xs)))
+	}
+	b := math.Float64bits(float64(xs[0].Eval()))
+	exp := int(b >> 52 & 0x7ff)
+	fmt.Fprintf(output, "hex:      %#016x\n", b)
+	fmt.Fprintln(output, "sign:    ", b>>63)
+	switch exp {
+	case 0:
+		fmt.Fprintf(output, "exponent: %d (zero or subnormal, 2^-1022)\n", exp)
+	case 0x7ff:
+		fmt.Fprintf(output, "exponent: %d (inf or nan)\n", exp)
+	default:
+		fmt.Fprintf(output, "exponent: %d (2^%d)\n", exp, exp-1023)
+	}
+	fmt.Fprintf(output, "mantissa: %#013x\n", b&(1<<52-1))
+}
+
+// 変数、定数、関数の一覧
+func cmdEnv(lex *Lex) {
+	endStatement(lex)
+	fmt.Fprintln(output, "variables:")
+	var names []string
+	for v := range globalEnv {
+		names = append(names, string(v))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(output, "  %v = %v\n", name, formatValue(globalEnv[Variable(name)]))
+	}
+	fmt.Fprintln(output, "constants:")
+	names = names[:0]
+	for name := range constTable {
+		names = append(names, name)
+	}
+	for name := range defineTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, _ := lookupConst(name)
+		fmt.Fprintf(output, "  %v = %v\n", name, formatValue(c))
+	}
+	fmt.Fprintln(output, "functions:")
+	var builtins []string
+	names = names[:0]
+	for name, fn := range funcTable {
+		if _, ok := fn.(*UserFunc); ok {
+			names = append(names, name)
+		} else if fn.Argc() < 0 {
+			builtins = append(builtins, name+"/n")
+		} else {
+			builtins = append(builtins, fmt.Sprintf("%v/%d", name, fn.Argc()))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(output, "  %v\n", signature(funcTable[name].(*UserFunc)))
+	}
+	for name := range specialTable {
+		builtins = append(builtins, name)
+	}
+	for name, tf := range tupleTable {
+		if tf.argc < 0 {
+			builtins = append(builtins, name+"/n")
+		} else {
+			builtins = append(builtins, fmt.Sprintf("%v/%d", name, tf.argc))
+		}
+	}
+	sort.Strings(builtins)
+	fmt.Fprintln(output, "builtins:")
+	fmt.Fprintf(output, "  %v\n", strings.Join(builtins, " "))
+}
+
+// ユーザ定義関数の引数の形 (省略できる引数は [] で囲む)
+func signature(f *UserFunc) string {
+	ps := make([]string, len(f.params))
+	for i, p := range f.params {
+		if f.defaults[i] != nil {
+			ps[i] = "[" + string(p) + "]"
+		} else {
+			ps[i] = string(p)
+		}
+	}
+	return f.name + "(" + strings.Join(ps, ", ") + ")"
+}
+
+// 変数の値の範囲の宣言 (範囲外の値を代入するとエラーになる)
+// range x [0, 10];
+func cmdRange(lex *Lex) {
+	if lex.Token != scanner.Ident {
+		panic(fmt.Errorf("variable name expected"))
+	}
+	v := Variable(lex.text)
+	lex.getToken()
+	if lex.Token != '[' {
+		panic(fmt.Errorf("'[' expected"))
+	}
+	lex.getToken()
+	lo := expression(lex)
+	if lex.Token != argSep() {
+		panic(fmt.Errorf("unexpected token in range"))
+	}
+	lex.getToken()
+	hi := expression(lex)
+	if lex.Token != ']' {
+		panic(fmt.Errorf("']' expected"))
+	}
+	lex.getToken()
+	endStatement(lex)
+	r := [2]Value{lo.Eval(), hi.Eval()}
+	if !(r[0] <= r[1]) {
+		panic(fmt.Errorf("invalid range: [%v, %v]", r[0], r[1]))
+	}
+	if x, ok := globalEnv[v]; ok && !(x >= r[0] && x <= r[1]) {
+		panic(fmt.Errorf("value out of range: %v = %v not in [%v, %v]", v, x, r[0], r[1]))
+	}
+	rangeTable[v] = r
+}
+
+// いま束縛されている変数をすべて読み出し専用にする (ans は除く)
+// 新しい変数は作れる。unfreeze ですべて元に戻す。
+// freeze; unfreeze;
+func cmdFreeze(lex *Lex) {
+	endStatement(lex)
+	for v := range globalEnv {
+		if v != "ans" {
+			frozenVars[v] = true
+		}
+	}
+}
+
+func cmdUnfreeze(lex *Lex) {
+	endStatement(lex)
+	clear(frozenVars)
+}
+
+// 変数への代入を表示する (引数がなければ表示中の変数の一覧)
+// watch x; unwatch x; watch;
+func cmdWatch(lex *Lex) {
+	if lex.Token == ';' {
+		var names []string
+		for v := range watchedVars {
+			names = append(names, string(v))
+		}
+		sort.Strings(names)
+		fmt.Fprintln(output, strings.Join(names, " "))
+		return
+	}
+	watchedVars[watchName(lex)] = true
+}
+
+func cmdUnwatch(lex *Lex) {
+	delete(watchedVars, watchName(lex))
+}
+
+func watchName(lex *Lex) Variable {
+	if lex.Token != scanner.Ident {
+		panic(fmt.Errorf("variable name expected"))
+	}
+	v := Variable(lex.text)
+	lex.getToken()
+	endStatement(lex)
+	return v
+}
+
+// 定数の定義
+// define G = 9.81;
+func cmdDefine(lex *Lex) {
+	if lex.Token != scanner.Ident {
+		panic(fmt.Errorf("constant name expected"))
+	}
+	name := lex.text
+	if _, ok := lookupConst(name); ok {
+		panic(fmt.Errorf("constant already defined: %v", name))
+	} else if _, ok := funcTable[name]; ok {
+		panic(fmt.Errorf("name already used by function: %v", name))
+	} else if _, ok := specialTable[name]; ok {
+		panic(fmt.Errorf("name already used by function: %v", name))
+	} else if _, ok := globalEnv[Variable(name)]; ok {
+		panic(fmt.Errorf("name already used by variable: %v", name))
+	}
+	lex.getToken()
+	if lex.Token != '=' {
+		panic(fmt.Errorf("'=' expected"))
+	}
+	lex.getToken()
+	e := expression(lex)
+	endStatement(lex)
+	defineTable[name] = e.Eval()
+	parseCache.clear()
+}
+
+// 関数の定義
+// def f(x, y = 1) = x + y;
+func cmdDef(lex *Lex) {
+	if lex.Token != scanner.Ident {
+		panic(fmt.Errorf("function name expected"))
+	}
+	name := lex.text
+	old, ok := funcTable[name]
+	if _, user := old.(*UserFunc); ok && !user {
+		panic(fmt.Errorf("cannot redefine built-in function: %v", name))
+	}
+	if _, ok := specialTable[name]; ok {
+		panic(fmt.Errorf("cannot redefine built-in function: %v", name))
+	} else if _, ok := tupleTable[name]; ok {
+		panic(fmt.Errorf("cannot redefine built-in function: %v", name))
+	}
+	lex.getToken()
+	f := &UserFunc{name: name}
+	if lex.Token != '(' {
+		panic(fmt.Errorf("'(' expected"))
+	}
+	lex.getToken()
+	for lex.Token != ')' {
+		if lex.Token != scanner.Ident {
+			panic(fmt.Errorf("parameter name expected"))
+		}
+		p := Variable(lex.text)
+		if _, ok := funcTable[lex.text]; ok {
+			panic(fmt.Errorf("parameter shadows function: %v", p))
+		} else if _, ok := lookupConst(lex.text); ok {
+			panic(fmt.Errorf("parameter shadows constant: %v", p))
+		}
+		for _, q := range f.params {
+			if p == q {
+				panic(fmt.Errorf("duplicate parameter: %v", p))
+			}
+		}
+		lex.getToken()
+		var d Expr
+		if lex.Token == '=' {
 			lex.getToken()
-			e = newOp2('+', e, term(lex))
-		case '-':
+			d = expression(lex)
+		} else if len(f.defaults) > 0 && f.defaults[len(f.defaults)-1] != nil {
+			panic(fmt.Errorf("parameter without default follows default: %v", p))
+		}
+		f.params = append(f.params, p)
+		f.defaults = append(f.defaults, d)
+		if lex.Token == argSep() {
 			lex.getToken()
-			e = newOp2('-', e, term(lex))
+		} else if lex.Token != ')' {
+			panic(fmt.Errorf("unexpected token in parameter list"))
+		}
+	}
+	lex.getToken()
+	if lex.Token != '=' {
+		panic(fmt.Errorf("'=' expected"))
+	}
+	lex.getToken()
+	// 再帰呼び出しのため本体より先に登録し、失敗したら元に戻す
+	funcTable[name] = f
+	defer func() {
+		if err := recover(); err != nil {
+			if ok {
+				funcTable[name] = old
+			} else {
+				delete(funcTable, name)
+			}
+			panic(err)
+		}
+	}()
+	f.body = expression(lex)
+	endStatement(lex)
+	parseCache.clear()
+}
+
+// maxdepth で設定できる上限
+// Go のスタックが溢れると recover できずにプロセスが終わるので、それより十分に小さくする。
+const maxMaxDepth = 10000
+
+// 再帰の深さの上限の表示と設定
+// maxdepth; maxdepth 1000;
+func cmdMaxDepth(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, maxDepth)
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	n := e.Eval()
+	if !(n > 0) {
+		panic(fmt.Errorf("maxdepth must be positive"))
+	} else if n > maxMaxDepth {
+		panic(fmt.Errorf("maxdepth too large: at most %v", maxMaxDepth))
+	}
+	maxDepth = int(n)
+}
+
+// approx の許容誤差の表示と設定
+// eps; eps 1e-12;
+func cmdEps(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, epsilon)
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	v := float64(e.Eval())
+	if !(v >= 0) {
+		panic(fmt.Errorf("eps must not be negative"))
+	}
+	epsilon = v
+}
+
+// 直前の文を $EDITOR で編集して評価する
+// edit;
+func cmdEdit(lex *Lex) {
+	endStatement(lex)
+	if lex.src != os.Stdin || !isTerminal(os.Stdin) {
+		panic(fmt.Errorf("edit: not an interactive session"))
+	}
+	if lastSource == "" {
+		panic(fmt.Errorf("edit: no previous input"))
+	}
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	f, err := os.CreateTemp("", "calc-*.txt")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(lastSource + "\n")
+	f.Close()
+	if err != nil {
+		panic(err)
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		panic(fmt.Errorf("edit: %v", err))
+	}
+	buf, err := os.ReadFile(f.Name())
+	if err != nil {
+		panic(err)
+	}
+	src := newLex(bytes.NewReader(buf))
+	for !toplevel(src) {
+	}
+}
+
+// 端末からの入力か
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// 表示の設定
+var precision = -1   // 小数点以下の桁数 (負なら必要なだけ)
+var grouping = false // 整数部を 3 桁ごとに区切る
+var groupSep = ","
+
+// precision で設定できる上限
+// float64 の10進展開は小数点以下 1074 桁で尽きるが、表示のたびに大きな文字列を作らないように抑える。
+const maxPrecision = 1000
+
+// 値の表示
+// precision を指定しなければ、読み直すと同じ float64 になる最短の10進表記にする
+// (0.1 + 0.2 は 0.30000000000000004、0.3 は 0.3)。
+func formatValue(v Value) string {
+	x := float64(v)
+	if dms && !math.IsNaN(x) && !math.IsInf(x, 0) {
+		return formatDMS(x)
+	}
+	if siPrefix && x != 0 && !math.IsNaN(x) && !math.IsInf(x, 0) {
+		return formatSI(x)
+	}
+	if math.IsNaN(x) || math.IsInf(x, 0) || (precision < 0 && !grouping) {
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	s := strconv.FormatFloat(x, 'f', precision, 64)
+	if grouping {
+		s = groupDigits(s, groupSep)
+	}
+	return s
+}
+
+// SI 接頭辞を付けて表示する (1500000 は 1.5M、0.0023 は 2.3m)
+var siPrefix = false
+
+var siPrefixes = []string{"y", "z", "a", "f", "p", "n", "µ", "m", "", "k", "M", "G", "T", "P", "E", "Z", "Y"}
+
+// 指数が 3 の倍数になるように仮数を 1 以上 1000 未満にして接頭辞を付ける
+// 1e27 以上は Y、1e-24 未満は y を付け、仮数は 1 以上 1000 未満に収まらない。
+// 仮数は 15 桁に丸めて割り算の誤差を隠す (precision を指定すればその桁数)。
+func formatSI(x float64) string {
+	e := int(math.Floor(math.Log10(math.Abs(x))/3)) * 3
+	e = max(-24, min(e, 24))
+	s := siMantissa(x / math.Pow(10, float64(e)))
+	// 丸めで 1000 に繰り上がったら次の接頭辞にする (999999.99999999 は 1000k ではなく 1M)
+	if m, _ := strconv.ParseFloat(s, 64); math.Abs(m) >= 1000 && e < 24 {
+		e += 3
+		s = siMantissa(x / math.Pow(10, float64(e)))
+	}
+	return s + siPrefixes[e/3+8]
+}
+
+func siMantissa(m float64) string {
+	if precision >= 0 {
+		return strconv.FormatFloat(m, 'f', precision, 64)
+	}
+	return strconv.FormatFloat(m, 'g', 15, 64)
+}
+
+// 整数部に区切り文字を入れる
+func groupDigits(s, sep string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	frac := ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		s, frac = s[:i], s[i:]
+	}
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteString(sep)
+		}
+		b.WriteRune(c)
+	}
+	return sign + b.String() + frac
+}
+
+// 小数点以下の桁数の表示と設定
+// precision; precision 4; precision -1; (必要なだけ)
+func cmdPrecision(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, precision)
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	v := e.Eval()
+	if v > maxPrecision {
+		panic(fmt.Errorf("precision too large: at most %v", maxPrecision))
+	}
+	n := int(v)
+	if n < 0 {
+		n = -1
+	}
+	precision = n
+}
+
+// 区切り文字の設定
+// groupsep comma; groupsep space; groupsep underscore;
+func cmdGroupSep(lex *Lex) {
+	seps := map[string]string{"comma": ",", "space": " ", "underscore": "_"}
+	sep, ok := seps[lex.text]
+	if !ok {
+		panic(fmt.Errorf("'comma', 'space' or 'underscore' expected"))
+	}
+	lex.getToken()
+	endStatement(lex)
+	groupSep = sep
+}
+
+// 値のスタック
+var stack []Value
+
+// スタックの先頭の表示
+func showStack() {
+	if len(stack) == 0 {
+		fmt.Fprintln(output, "(empty)")
+	} else {
+		fmt.Fprintln(output, formatValue(stack[len(stack)-1]))
+	}
+}
+
+// 式を評価してスタックに積む
+// push expr;
+func cmdPush(lex *Lex) {
+	e := expression(lex)
+	endStatement(lex)
+	stack = append(stack, e.Eval())
+	showStack()
+}
+
+// スタックの先頭 n 個を取り出して fn の結果を積むコマンド
+func stackCommand(n int, fn func([]Value) []Value) func(*Lex) {
+	return func(lex *Lex) {
+		endStatement(lex)
+		if len(stack) < n {
+			panic(fmt.Errorf("stack underflow"))
+		}
+		xs := append([]Value(nil), stack[len(stack)-n:]...)
+		stack = append(stack[:len(stack)-n], fn(xs)...)
+		showStack()
+	}
+}
+
+// メモリ
+var memory Value
+
+// メモリへの加算と減算
+// M+; M-; は直前の結果 ans を、M+ expr; M- expr; は式の値を使う。
+// ans は式の文を評価するたびに更新され、コマンドでは変わらない。
+func cmdMemory(lex *Lex) {
+	op := lex.Token
+	if op != '+' && op != '-' {
+		panic(fmt.Errorf("'M+' or 'M-' expected"))
+	}
+	lex.getToken()
+	var e Expr = Variable("ans")
+	if lex.Token != ';' {
+		e = expression(lex)
+	}
+	endStatement(lex)
+	v := e.Eval()
+	if op == '+' {
+		memory += v
+	} else {
+		memory -= v
+	}
+	fmt.Fprintln(output, formatValue(memory))
+}
+
+// メモリの表示
+// MR;
+func cmdMemoryRecall(lex *Lex) {
+	endStatement(lex)
+	fmt.Fprintln(output, formatValue(memory))
+}
+
+// メモリの消去
+// MC;
+func cmdMemoryClear(lex *Lex) {
+	endStatement(lex)
+	memory = 0
+}
+
+// 構文木のキャッシュの表示と設定
+// cache; cache 100; cache clear;
+func cmdCache(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintf(output, "%d/%d\n", parseCache.ll.Len(), parseCache.size)
+		return
+	}
+	if lex.Token == scanner.Ident && lex.text == "clear" {
+		lex.getToken()
+		endStatement(lex)
+		parseCache.clear()
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	n := int(e.Eval())
+	if n < 0 {
+		panic(fmt.Errorf("cache size must not be negative"))
+	}
+	parseCache.size = n
+	parseCache.trim()
+}
+
+// big.Float の精度 (ビット数) の表示と設定
+// bigprec; bigprec 512;
+func cmdBigPrec(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, bigPrec)
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	n := int(e.Eval())
+	if n <= 0 || n > big.MaxPrec {
+		panic(fmt.Errorf("bigprec out of range"))
+	}
+	bigPrec = uint(n)
+}
+
+// integrate の分割数の表示と設定 (奇数なら切り上げる)
+// subdiv; subdiv 2000;
+func cmdSubdiv(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, subdivisions)
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	n := int(e.Eval())
+	if n <= 0 {
+		panic(fmt.Errorf("subdiv must be positive"))
+	}
+	subdivisions = n + n%2
+}
+
+// plot の大きさの上限
+const maxPlotWidth, maxPlotHeight = 1000, 500
+
+// plot の大きさの表示と設定
+// plotsize; plotsize 60 20;
+// 幅と高さは別々の項として読む (60 -20 を 60-20 としない)。式は括弧で囲む。
+func cmdPlotSize(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, plotWidth, plotHeight)
+		return
+	}
+	w := unary(lex)
+	h := unary(lex)
+	endStatement(lex)
+	width, height := float64(w.Eval()), float64(h.Eval())
+	if !(width >= 2 && height >= 2) {
+		panic(fmt.Errorf("plotsize too small"))
+	}
+	if width > maxPlotWidth || height > maxPlotHeight {
+		panic(fmt.Errorf("plotsize too large: at most %v %v", maxPlotWidth, maxPlotHeight))
+	}
+	plotWidth, plotHeight = int(width), int(height)
+}
+
+// table, map の列の幅の表示と設定
+// tablewidth; tablewidth 12;
+func cmdTableWidth(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, tableWidth)
+		return
+	}
+	w := expression(lex)
+	endStatement(lex)
+	width := int(w.Eval())
+	if width < 0 {
+		panic(fmt.Errorf("tablewidth must be non-negative"))
+	}
+	tableWidth = width
+}
+
+// 数値の小数点の設定
+// decimalsep point; (既定、3.14 と f(1, 2))
+// decimalsep comma; (3,14 と f(1; 2))
+// コンマを小数点にすると引数の区切りと区別できないので、
+// 関数の引数や仮引数は ; で区切る。文の終わりの ; は括弧の外に書く。
+func cmdDecimalSep(lex *Lex) {
+	var comma bool
+	switch lex.text {
+	case "point":
+		comma = false
+	case "comma":
+		comma = true
+	default:
+		panic(fmt.Errorf("'point' or 'comma' expected"))
+	}
+	lex.getToken()
+	endStatement(lex)
+	decimalComma = comma
+	parseCache.clear()
+}
+
+// 文字列の引数の取得 ("..." またはエスケープを解釈しない `...`)
+func getString(lex *Lex) string {
+	if lex.Token != scanner.String && lex.Token != scanner.RawString {
+		panic(fmt.Errorf("string expected"))
+	}
+	s, err := strconv.Unquote(lex.text)
+	if err != nil {
+		panic(err)
+	}
+	lex.getToken()
+	return s
+}
+
+// 構文木を字下げして表示する (評価はしない)
+// tree 1 + 2 * x;
+func cmdTree(lex *Lex) {
+	e := expression(lex)
+	endStatement(lex)
+	printTree(e, 0)
+}
+
+func printTree(e Expr, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch x := e.(type) {
+	case nil:
+		fmt.Fprintln(output, indent+"(default)")
+		return
+	case Value:
+		fmt.Fprintf(output, "%vValue(%v)\n", indent, formatValue(x))
+	case Variable:
+		fmt.Fprintf(output, "%vVariable(%v)\n", indent, x)
+	case EvalStr:
+		fmt.Fprintf(output, "%vEvalStr(%q)\n", indent, string(x))
+	case *Op1:
+		fmt.Fprintf(output, "%vOp1(%v)\n", indent, opName(x.code))
+	case *Op2:
+		fmt.Fprintf(output, "%vOp2(%v)\n", indent, opName(x.code))
+	case *Chain:
+		ops := make([]string, len(x.codes))
+		for i, c := range x.codes {
+			ops[i] = opName(c)
+		}
+		fmt.Fprintf(output, "%vChain(%v)\n", indent, strings.Join(ops, " "))
+	case *Agn:
+		if x.decl {
+			fmt.Fprintf(output, "%vAgn(%v :=)\n", indent, x.name)
+		} else {
+			fmt.Fprintf(output, "%vAgn(%v =)\n", indent, x.name)
+		}
+	case *App:
+		fmt.Fprintf(output, "%vApp(%v)\n", indent, x.name)
+	case *Form:
+		fmt.Fprintf(output, "%vForm(%v)\n", indent, x.name)
+	default:
+		fmt.Fprintf(output, "%v%T\n", indent, x)
+	}
+	for _, y := range children(e) {
+		printTree(y, depth+1)
+	}
+}
+
+// 演算子のコードの表記
+func opName(code rune) string {
+	for op, tok := range opTokens {
+		if tok == code {
+			return op
+		}
+	}
+	return string(code)
+}
+
+// profile で繰り返す回数
+const profileRuns = 1000
+
+// 構文解析と評価の時間の計測 (profileRuns 回の平均)
+// 式は繰り返し評価されるので、代入などの副作用も繰り返される。
+// profile "sin(1) + 2";
+func cmdProfile(lex *Lex) {
+	src := getString(lex)
+	endStatement(lex)
+	var e Expr
+	start := time.Now()
+	for i := 0; i < profileRuns; i++ {
+		e = parseString(src)
+	}
+	parse := time.Since(start) / profileRuns
+	checkCost(e)
+	start = time.Now()
+	for i := 0; i < profileRuns; i++ {
+		opCount = 0
+		e.Eval()
+	}
+	eval := time.Since(start) / profileRuns
+	fmt.Fprintln(output, "parse:", parse)
+	fmt.Fprintln(output, "eval: ", eval)
+	fmt.Fprintln(output, "total:", parse+eval)
+}
+
+// 字句解析の結果の表示 (評価はしない)
+// tokens "x <= 1.5e3";
+func cmdTokens(lex *Lex) {
+	src := getString(lex)
+	endStatement(lex)
+	l := newLex(strings.NewReader(src))
+	for {
+		l.scan()
+		switch {
+		case l.Token == scanner.EOF:
+			return
+		case l.Token == '\n':
+			fmt.Fprintln(output, "Newline")
+		case l.Token < 0 && l.Token > tokDecl:
+			fmt.Fprintf(output, "%-8v %v\n", scanner.TokenString(l.Token), l.text)
+		case l.Token == tokDMS:
+			fmt.Fprintf(output, "%-8v %v\n", "DMS", l.text)
 		default:
-			return e
+			fmt.Fprintf(output, "%-8v %v\n", "Op", l.text)
 		}
 	}
 }
 
-func expression(lex *Lex) Expr {
-	e := expr1(lex)
-	if lex.Token == '=' {
-		v, ok := e.(Variable)
-		if ok {
-			lex.getToken()
-			return newAgn(v, expression(lex))
+// load のあとに未使用の代入を報告する
+var lintMode = false
+
+// ファイルの読み込みと評価
+// load "file";
+func cmdLoad(lex *Lex) {
+	name := getString(lex)
+	endStatement(lex)
+	f, err := os.Open(name)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	src := newLex(f)
+	src.keep = lintMode
+	for !toplevel(src) {
+	}
+	for _, w := range lint(src.stmts) {
+		fmt.Fprintf(warnOutput, "warning: %v: %v\n", name, w)
+	}
+}
+
+// 角度の単位の切り替え
+// rad; deg; grad;
+func setAngleMode(mode string) func(*Lex) {
+	return func(lex *Lex) {
+		endStatement(lex)
+		angleMode = mode
+	}
+}
+
+// 結果の履歴 (リングバッファ)
+type ring struct {
+	buf  []Value
+	next int // 次に書き込む位置
+	n    int // 格納している個数
+}
+
+func newRing(size int) *ring {
+	return &ring{buf: make([]Value, size)}
+}
+
+func (r *ring) push(v Value) {
+	if len(r.buf) == 0 {
+		return
+	}
+	r.buf[r.next] = v
+	r.next = (r.next + 1) % len(r.buf)
+	if r.n < len(r.buf) {
+		r.n++
+	}
+}
+
+// k 番目に新しい値 (1 が最新)
+func (r *ring) get(k int) Value {
+	return r.buf[(r.next-k+len(r.buf))%len(r.buf)]
+}
+
+// 新しいものから size 個を残して大きさを変える
+func (r *ring) resize(size int) *ring {
+	nr := newRing(size)
+	for k := min(r.n, size); k >= 1; k-- {
+		nr.push(r.get(k))
+	}
+	return nr
+}
+
+var results = newRing(10)
+
+// lastsize で設定できる上限
+const maxLastSize = 100000
+
+// prev, next で表示している履歴の位置 (1 が最新、0 なら未選択)
+var cursor = 0
+
+// 式の文の結果を ans と履歴に残す (prev, next の位置は最新に戻る)
+func setResult(v Value) {
+	globalEnv["ans"] = v
+	results.push(v)
+	cursor = 0
+}
+
+// 履歴の位置を d だけ古い方へ動かして表示する
+// 端では止まる (最も古い結果で prev、最新の結果で next をしても動かない)。
+// prev; next;
+func moveCursor(d int) func(*Lex) {
+	return func(lex *Lex) {
+		endStatement(lex)
+		if results.n == 0 {
+			panic(fmt.Errorf("no results"))
+		}
+		cursor = max(1, min(cursor+d, results.n))
+		fmt.Fprintf(output, "%d: %v\n", cursor, formatValue(results.get(cursor)))
+	}
+}
+
+// 結果の履歴の表示
+// last; (新しい順に番号付きで表示) last 2; (2 番目に新しい結果)
+func cmdLast(lex *Lex) {
+	if lex.Token == ';' {
+		for k := 1; k <= results.n; k++ {
+			fmt.Fprintf(output, "%d: %v\n", k, formatValue(results.get(k)))
+		}
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	k := int(e.Eval())
+	if k < 1 || k > results.n {
+		panic(fmt.Errorf("no such result: %d", k))
+	}
+	fmt.Fprintln(output, formatValue(results.get(k)))
+}
+
+// 結果の履歴の大きさの表示と設定
+// lastsize; lastsize 20;
+func cmdLastSize(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, len(results.buf))
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	v := e.Eval()
+	if !(v >= 0) {
+		panic(fmt.Errorf("lastsize must not be negative"))
+	} else if v > maxLastSize {
+		panic(fmt.Errorf("lastsize too large: at most %v", maxLastSize))
+	}
+	results = results.resize(int(v))
+	cursor = min(cursor, results.n)
+}
+
+// 評価の手間の上限の表示と設定
+// maxcost; maxcost 10000; maxcost 0; (制限しない)
+func cmdMaxCost(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, maxCost)
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	n := int(e.Eval())
+	if n < 0 {
+		panic(fmt.Errorf("maxcost must not be negative"))
+	}
+	maxCost = n
+}
+
+// 代入式も名前を付けずに値だけを表示する (x = 5 で 5、以前の表示)
+var quietAssign = false
+
+// 共通部分式を一度だけ評価する (EvalCSE を使う)
+var cse = false
+
+// 最後に代入を含む文で書き換えた変数の元の値 (undo で戻す)
+var undoEnv map[Variable]savedVar
+
+// 評価中の文で書き換えた変数の元の値 (nil なら記録しない)
+// 変数ごとに最初に書き換える前の値だけを記録するので、手間は代入した変数の数に比例する。
+var undoLog map[Variable]savedVar
+
+// 変数 v を書き換える前に元の値を記録する
+func logUndo(v Variable) {
+	if undoLog == nil {
+		return
+	}
+	if _, ok := undoLog[v]; !ok {
+		val, ok := globalEnv[v]
+		undoLog[v] = savedVar{v, val, ok}
+	}
+}
+
+// 記録した変数を元の値に戻す
+func rollback(log map[Variable]savedVar) {
+	for v, s := range log {
+		if s.ok {
+			globalEnv[v] = s.val
 		} else {
-			panic(fmt.Errorf("invalid assign form"))
+			delete(globalEnv, v)
 		}
 	}
-	return e
+}
+
+// 文を評価する (エラーが起きたら文の中の代入をすべて取り消す)
+// 書き換えた変数の元の値を返す。評価中に呼ばれたときは外側の文に記録を任せる。
+func evalAtomic(eval func() Value) (v Value, log map[Variable]savedVar) {
+	if undoLog != nil {
+		return eval(), nil
+	}
+	log = make(map[Variable]savedVar)
+	undoLog = log
+	defer func() {
+		undoLog = nil
+		if err := recover(); err != nil {
+			rollback(log)
+			panic(err)
+		}
+	}()
+	v = eval()
+	// 関数の引数のように、評価の終わりに元の値に戻った変数は取り消すものがない
+	for name, s := range log {
+		if val, ok := globalEnv[name]; ok == s.ok && val == s.val {
+			delete(log, name)
+		}
+	}
+	return v, log
+}
+
+// 最後に代入を含む文を評価する前の変数に戻す (ans はそのまま)
+// undo;
+func cmdUndo(lex *Lex) {
+	endStatement(lex)
+	if undoEnv == nil {
+		panic(fmt.Errorf("nothing to undo"))
+	}
+	delete(undoEnv, "ans")
+	rollback(undoEnv)
+	undoEnv = nil
+}
+
+// 式を評価する前に入力した式を表示する (コマンドは表示しない)
+var echo = false
+
+// Parse に渡せる文字列の長さの上限の表示と設定
+// maxinput; maxinput 1024; maxinput 0; (制限しない)
+func cmdMaxInput(lex *Lex) {
+	if lex.Token == ';' {
+		fmt.Fprintln(output, maxInput)
+		return
+	}
+	e := expression(lex)
+	endStatement(lex)
+	n := int(e.Eval())
+	if n < 0 {
+		panic(fmt.Errorf("maxinput must not be negative"))
+	}
+	maxInput = n
 }
 
 // 式の入力と評価
 func toplevel(lex *Lex) (r bool) {
 	r = false
+	start := -1
 	defer func() {
-		err := recover()
-		if err != nil {
+		if err := recover(); err != nil {
 			mes, ok := err.(string)
 			if ok && mes == "quit" {
 				r = true
 			} else {
 				fmt.Fprintln(os.Stderr, err)
-				for lex.Token != ';' {
-					lex.getToken()
+				if err != errCanceled {
+					lex.skipLine()
+					lex.record(start)
 				}
 			}
 		}
 	}()
 	for {
-		fmt.Print("Calc> ")
+		if lex.prompt {
+			fmt.Fprint(output, "Calc> ")
+		}
+		lex.more = false
+		start = -1
 		lex.getToken()
+		if lex.Token == scanner.EOF {
+			// EOF (Ctrl-D) で終了する
+			if lex.prompt {
+				fmt.Fprintln(output)
+			}
+			return true
+		}
+		start = lex.pos
+		lex.more = true
+		if lex.Token == scanner.Ident && lex.peekToken() == '?' {
+			name := lex.text
+			lex.getToken()
+			lex.getToken()
+			endStatement(lex)
+			showHelp(name)
+			lex.record(start)
+			continue
+		}
+		if cmd, ok := command(lex); ok {
+			if lex.text == "edit" {
+				start = -1
+			}
+			lex.getToken()
+			cmd(lex)
+			lex.record(start)
+			continue
+		}
 		e := expression(lex)
 		if lex.Token != ';' {
 			panic(fmt.Errorf("invalid expression"))
 		} else {
-			fmt.Println(e.Eval())
+			if lex.keep {
+				lex.stmts = append(lex.stmts, e)
+			}
+			if echo {
+				fmt.Fprintln(output, ">", strings.TrimSpace(lex.source(start)))
+			}
+			beginEval(e)
+			// 文の評価中にエラーが起きたら、その文の代入をすべて取り消す
+			var s string
+			v, log := evalAtomic(func() Value {
+				if bigMode {
+					b := evalBig(e)
+					s = formatBig(b)
+					f, _ := b.Float64()
+					return Value(f)
+				} else if cse {
+					v, err := EvalCSE(e)
+					if err != nil {
+						panic(err)
+					}
+					return v
+				}
+				return e.Eval()
+			})
+			if len(log) > 0 {
+				undoEnv = log
+			}
+			setResult(v)
+			if !bigMode {
+				s = formatValue(v)
+			}
+			if a, ok := e.(*Agn); ok && !quietAssign {
+				// a = b = 5 は a と b をまとめて表示する
+				for ; ok; a, ok = a.expr.(*Agn) {
+					fmt.Fprintf(output, "%v = ", a.name)
+				}
+			}
+			fmt.Fprintln(output, s)
+			lastOps = opCount
 		}
+		lex.record(start)
 	}
-	return r
 }
 
 func main() {
-	var lex Lex
-	lex.Init(os.Stdin)
+	lex := newLex(os.Stdin)
+	lex.prompt = true
 	initFunc()
+	initSpecial()
+	initCommand()
 	for {
-		if toplevel(&lex) {
+		if toplevel(lex) {
 			break
 		}
 	}
@@ -0,0 +1,1639 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	initFunc()
+	initSpecial()
+	initCommand()
+	os.Exit(m.Run())
+}
+
+// 新しいセッションで REPL に入力を与え、標準出力と標準エラー出力をまとめて返す
+func repl(t *testing.T, input string) string {
+	t.Helper()
+	return replFrom(t, strings.NewReader(input))
+}
+
+func replFrom(t *testing.T, input io.Reader) string {
+	t.Helper()
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := NewSession()
+	s.swap()
+	defer s.swap()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	output, warnOutput = w, w
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	lex := newLex(input)
+	for !toplevel(lex) {
+	}
+	w.Close()
+	os.Stdout, os.Stderr = stdout, stderr
+	output, warnOutput = stdout, stderr
+	return <-out
+}
+
+// セッションで文を順に評価し、最後の値を返す (エラーならテストを止める、表示は捨てる)
+func mustEval(t *testing.T, s *Session, srcs ...string) Value {
+	t.Helper()
+	var v Value
+	for _, src := range srcs {
+		var err error
+		if v, err = s.EvalTo(io.Discard, src); err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+	}
+	return v
+}
+
+// HTTP のハンドラに式を送り、状態と JSON の本文を返す
+func post(t *testing.T, srv *httptest.Server, c *http.Cookie, src string) (int, map[string]interface{}, *http.Cookie) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != nil {
+		req.AddCookie(c)
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var body map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	for _, rc := range res.Cookies() {
+		if rc.Name == "calc-session" {
+			c = rc
+		}
+	}
+	return res.StatusCode, body, c
+}
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+
+	status, body, c := post(t, srv, nil, "2 + 3 * 4")
+	if status != http.StatusOK || body["result"] != 14.0 {
+		t.Fatalf("2 + 3 * 4: %v %v", status, body)
+	}
+	if c == nil {
+		t.Fatal("no session cookie")
+	}
+	if status, body, _ := post(t, srv, nil, "1 / 0"); status != http.StatusBadRequest || body["error"] == nil {
+		t.Errorf("1 / 0: %v %v", status, body)
+	}
+
+	// クッキーがあれば同じセッションで評価し、なければ新しい環境で評価する
+	post(t, srv, c, "x = 5")
+	if _, body, _ := post(t, srv, c, "x * 2"); body["result"] != 10.0 {
+		t.Errorf("x * 2 in the session: %v", body)
+	}
+	if _, body, _ := post(t, srv, nil, "x"); body["error"] == nil {
+		t.Errorf("x without a cookie: %v", body)
+	}
+
+	res, err := srv.Client().Get(srv.URL + "?expr=" + "sqrt(16)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&got)
+	res.Body.Close()
+	if got["result"] != 4.0 {
+		t.Errorf("GET ?expr=sqrt(16): %v", got)
+	}
+
+	// コマンドの表示は output で返す
+	if _, body, _ := post(t, srv, c, "push 3"); body["result"] != 0.0 || body["output"] != "3\n" {
+		t.Errorf("push 3: %v", body)
+	}
+	if _, body, _ := post(t, srv, c, "x"); body["output"] != nil {
+		t.Errorf("x: %v", body)
+	}
+}
+
+func TestHandlerMaxCost(t *testing.T) {
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+	// 既定の手間の上限で止まる (止まらなければテストが時間切れになる)
+	status, body, _ := post(t, srv, nil, "repeat(1, 1e12)")
+	if msg, _ := body["error"].(string); status != http.StatusBadRequest || !strings.Contains(msg, "maxcost") {
+		t.Errorf("repeat(1, 1e12): %v %v", status, body)
+	}
+
+	// bigfloat の階乗は引数の大きさに合わせて数える
+	_, _, c := post(t, srv, nil, "bigfloat on")
+	if _, body, _ := post(t, srv, c, "99999!"); body["error"] == nil {
+		t.Errorf("99999! in bigfloat: %v", body)
+	}
+	if _, body, _ := post(t, srv, c, "1000! > 0"); body["result"] != 1.0 {
+		t.Errorf("1000! > 0 in bigfloat: %v", body)
+	}
+	if _, body, _ := post(t, srv, c, "precision 1000000000"); body["error"] == nil {
+		t.Errorf("precision 1000000000: %v", body)
+	}
+}
+
+func TestHandlerSessionLimit(t *testing.T) {
+	sessionMu.Lock()
+	saved := sessions
+	sessions = make(map[string]*httpSess)
+	sessionMu.Unlock()
+	defer func() {
+		sessionMu.Lock()
+		sessions = saved
+		sessionMu.Unlock()
+	}()
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+
+	// 一つのクライアントがセッションを作り続けても、上限を超えては残らない
+	_, _, first := post(t, srv, nil, "a = 1")
+	for i := 0; i < maxClientSessions+5; i++ {
+		post(t, srv, nil, "1")
+	}
+	sessionMu.Lock()
+	n := len(sessions)
+	_, kept := sessions[first.Value]
+	sessionMu.Unlock()
+	if n != maxClientSessions {
+		t.Errorf("sessions of one client: %d, want %d", n, maxClientSessions)
+	}
+	if kept {
+		t.Error("the least recently used session of the client was not evicted")
+	}
+
+	// 他のクライアントの使われているセッションは捨てない
+	sessionMu.Lock()
+	for i := len(sessions); i < maxSessions; i++ {
+		sessions[strings.Repeat("x", i)] = &httpSess{NewSession(), "192.0.2.1", time.Now()}
+	}
+	sessionMu.Unlock()
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("1"))
+		req.RemoteAddr = "198.51.100.1:1234"
+		w := httptest.NewRecorder()
+		Handler().ServeHTTP(w, req)
+		return w
+	}
+	w := serve()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("new session when all are in use: %v %v", w.Code, w.Body)
+	}
+
+	// 使われていないセッションがあれば、それを捨てて新しいセッションを作る
+	sessionMu.Lock()
+	sessions[strings.Repeat("x", maxSessions-1)].used = time.Now().Add(-2 * sessionIdle)
+	sessionMu.Unlock()
+	w = serve()
+	if w.Code != http.StatusOK {
+		t.Errorf("new session after an idle one: %v %v", w.Code, w.Body)
+	}
+	sessionMu.Lock()
+	_, idle := sessions[strings.Repeat("x", maxSessions-1)]
+	sessionMu.Unlock()
+	if idle {
+		t.Error("the idle session was not evicted")
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	const src = "sqrt(x^2 + y^2) * sin(acos(-1) / 6) + max(1, 2, 3) / (4 - 2)"
+	saved := parseCache
+	defer func() { parseCache = saved }()
+	for _, size := range []int{0, 100} {
+		parseCache = newExprCache(size)
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := Parse(src); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEOF(t *testing.T) {
+	done := make(chan string)
+	go func() { done <- repl(t, "1 + 2;") }()
+	select {
+	case out := <-done:
+		if out != "3\n" {
+			t.Errorf("output: %q", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("toplevel did not return at EOF")
+	}
+	// 読み終わった入力でも何度でもすぐに終わる
+	lex := newLex(strings.NewReader(""))
+	for i := 0; i < 3; i++ {
+		if !toplevel(lex) {
+			t.Fatal("toplevel did not return true at EOF")
+		}
+	}
+}
+
+func TestRecursionDepth(t *testing.T) {
+	out := repl(t, "def f(x) = f(x);\nf(1);\n")
+	if !strings.Contains(out, "maximum recursion depth exceeded: f") {
+		t.Errorf("f(1): %q", out)
+	}
+	saved := maxDepth
+	defer func() { maxDepth = saved }()
+	out = repl(t, "maxdepth 10;\ndef g(n) = if(n <= 0, 0, 1 + g(n - 1));\ng(5);\ng(20);\n")
+	if out != "5\nmaximum recursion depth exceeded: g\n" {
+		t.Errorf("maxdepth 10: %q", out)
+	}
+	// 上限を超える深さは設定できない (Go のスタックが溢れるとプロセスが終わる)
+	out = repl(t, "maxdepth 100000000;\nmaxdepth;\nmaxdepth 10000;\ndef g(n) = if(n <= 0, 0, 1 + g(n - 1));\ng(9999);\n")
+	if out != "maxdepth too large: at most 10000\n1000\n9999\n" {
+		t.Errorf("maxdepth 100000000: %q", out)
+	}
+}
+
+// 式と期待する値の組
+type evalTest struct {
+	src  string
+	want Value
+}
+
+// 式を新しいセッションで一つずつ評価して値を確かめる
+func checkValues(t *testing.T, tests []evalTest) {
+	t.Helper()
+	for _, tt := range tests {
+		if got := mustEval(t, NewSession(), tt.src); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestApprox(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"sqrt(2)^2 == 2", 0},
+		{"approx(sqrt(2)^2, 2)", 1},
+		{"approx(sqrt(2)*sqrt(2), 2)", 1},
+		{"approx(1, 1.001)", 0},
+		{"approx(1e20, 1e20 + 1e10)", 1},
+	})
+	s := NewSession()
+	if v := mustEval(t, s, "eps 0.01", "approx(1, 1.001)"); v != 1 {
+		t.Errorf("approx(1, 1.001) with eps 0.01 = %v", v)
+	}
+}
+
+func TestDoubleStar(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"2**3", 8},
+		{"2**3**2", 512},
+		{"(2**3)**2", 64},
+		{"2**3 == 2^3", 1},
+		{"2*3**2", 18},
+		{"2**-1", 0.5},
+		{"-2**2", -4},
+	})
+	if _, err := NewSession().Eval("2 * * 3"); err == nil {
+		t.Error("2 * * 3: no error")
+	}
+}
+
+func TestSigns(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"3 * -2", -6},
+		{"3*-2", -6},
+		{"-3 * -2", 6},
+		{"-2^2", -4},
+		{"(-2)^2", 4},
+		{"2^-2", 0.25},
+		{"--5", 5},
+		{"-+5", -5},
+		{"+-5", -5},
+		{"---5", -5},
+		{"+5", 5},
+		{"2 - -3", 5},
+		{"2 + -3", -1},
+		{"-(2 + 3)", -5},
+	})
+}
+
+func TestIntegrate(t *testing.T) {
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"integrate(x*x, x, 0, 1)", 1.0 / 3},
+		{"integrate(sin(x), x, 0, acos(-1))", 2},
+		{"integrate(exp(x), x, 0, 1)", math.E - 1},
+		{"integrate(1/x, x, 1, 2)", math.Ln2},
+		{"integrate(x^3, x, 1, 0)", -0.25},
+	}
+	for _, tt := range tests {
+		if got := float64(mustEval(t, NewSession(), tt.src)); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+	// 変数の束縛は積分のあとに元に戻る
+	if v := mustEval(t, NewSession(), "x = 5", "integrate(x, x, 0, 1)", "x"); v != 5 {
+		t.Errorf("x after integrate = %v", v)
+	}
+	// 分割数を減らすと誤差が大きくなる
+	v := mustEval(t, NewSession(), "subdiv 10", "integrate(x^4, x, 0, 1)")
+	if d := math.Abs(float64(v) - 0.2); d < 1e-6 || d > 1e-3 {
+		t.Errorf("integrate(x^4, x, 0, 1) with subdiv 10 = %v", v)
+	}
+}
+
+func TestDecimalSep(t *testing.T) {
+	s := NewSession()
+	checks := []evalTest{
+		{"3.14 + 1", 4.140000000000001},
+		{"max(1.5, 2)", 2},
+		{"decimalsep comma", 0},
+		{"3,14 + 1", 4.140000000000001},
+		{"max(1,5; 2)", 2},
+		{"max(2,5; 2)", 2.5},
+		{"decimalsep point", 0},
+		{"max(1.5, 2)", 2},
+	}
+	for _, tt := range checks {
+		if got := mustEval(t, s, tt.src); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+	if _, err := s.Eval("decimalsep dot"); err == nil {
+		t.Error("decimalsep dot: no error")
+	}
+	// セッションの設定は他のセッションに影響しない
+	mustEval(t, s, "decimalsep comma")
+	if v := mustEval(t, NewSession(), "max(1.5, 2)"); v != 2 {
+		t.Errorf("max(1.5, 2) in another session = %v", v)
+	}
+}
+
+func TestChainedComparison(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"1 < 2 < 3", 1},
+		{"1 < 5 < 3", 0},
+		{"3 < 2 < 5", 0},
+		{"1 <= 1 < 2", 1},
+		{"1 < 2 < 3 < 4", 1},
+		{"1 < 2 < 3 < 3", 0},
+		{"3 > 2 > 1", 1},
+	})
+	// 真ん中の式は一度だけ評価する
+	s := NewSession()
+	if v := mustEval(t, s, "x = 0", "def m() = (x = x + 1)", "0 < m() < 2"); v != 1 {
+		t.Errorf("0 < m() < 2 = %v", v)
+	}
+	if v := mustEval(t, s, "x"); v != 1 {
+		t.Errorf("m() evaluated %v times", v)
+	}
+}
+
+func TestValueFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		v      Value
+		want   string
+	}{
+		{"%v", 0.1, "0.1"},
+		{"%v", 1e21, "1e+21"},
+		{"%v", Value(math.Inf(-1)), "-Inf"},
+		{"%s", 2.5, "2.5"},
+		{"%.3f", math.Pi, "3.142"},
+		{"%.3v", math.Pi, "3.14"},
+		{"%g", 1e-7, "1e-07"},
+		{"%e", 1234.5, "1.234500e+03"},
+		{"%8.2f", 2, "    2.00"},
+		{"%-6v|", 1.5, "1.5   |"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprintf(tt.format, tt.v); got != tt.want {
+			t.Errorf("Sprintf(%q, %v) = %q, want %q", tt.format, float64(tt.v), got, tt.want)
+		}
+	}
+}
+
+func TestAngleModes(t *testing.T) {
+	s := NewSession()
+	near := func(src string, want float64) {
+		t.Helper()
+		if got := float64(mustEval(t, s, src)); math.Abs(got-want) > 1e-12 {
+			t.Errorf("%s = %v, want %v", src, got, want)
+		}
+	}
+	mustEval(t, s, "grad")
+	near("sin(100)", 1)
+	near("cos(200)", -1)
+	near("asin(1)", 100)
+	mustEval(t, s, "deg")
+	near("sin(90)", 1)
+	near("atan(1)", 45)
+	mustEval(t, s, "rad")
+	near("sin(acos(-1) / 2)", 1)
+	near("acos(-1)", math.Pi)
+}
+
+func TestTruncFrac(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"trunc(3.7)", 3},
+		{"trunc(-3.7)", -3},
+		{"floor(-3.7)", -4},
+		{"ceil(-3.7)", -3},
+		{"trunc(-3)", -3},
+		{"frac(3.5)", 0.5},
+		{"frac(-3.5)", -0.5},
+		{"frac(4)", 0},
+	})
+	if v := mustEval(t, NewSession(), "x = -3.7", "trunc(x) + frac(x) == x"); v != 1 {
+		t.Errorf("trunc(x) + frac(x) == x: %v", v)
+	}
+}
+
+func TestSpecialFunctions(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"sinc(0)", 1},
+		{"sinc(acos(-1) / 2)", Value(2 / math.Pi)},
+		{"sinc(-acos(-1) / 2)", Value(2 / math.Pi)},
+		{"gamma(5)", 24},
+		{"gamma(1)", 1},
+		{"approx(gamma(0.5)^2, acos(-1))", 1},
+		{"logistic(0)", 0.5},
+		{"logistic(800)", 1},
+		{"logistic(-800)", 0},
+	})
+}
+
+func TestErf(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"erf(0)", 0},
+		{"erfc(0)", 1},
+		{"erf(inf)", 1},
+		{"erf(-0.5) == -erf(0.5)", 1},
+	})
+	s := NewSession()
+	for _, x := range []float64{-2, -0.5, 0.3, 1, 3} {
+		mustEval(t, s, fmt.Sprintf("x = %v", x))
+		if v := mustEval(t, s, "erf(x) + erfc(x)"); math.Abs(float64(v)-1) > 1e-15 {
+			t.Errorf("erf(%v) + erfc(%v) = %v", x, x, v)
+		}
+		if v := mustEval(t, s, "erfinv(erf(x))"); math.Abs(float64(v)-x) > 1e-12 {
+			t.Errorf("erfinv(erf(%v)) = %v", x, v)
+		}
+	}
+}
+
+func TestNormal(t *testing.T) {
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"normcdf(0)", 0.5},
+		{"normpdf(0)", 0.3989422804014327},
+		{"normcdf(1.96)", 0.9750021048517795},
+		{"normcdf(-1) + normcdf(1)", 1},
+		{"normpdf(1)", math.Exp(-0.5) / math.Sqrt(2*math.Pi)},
+		{"normcdf(-40)", 0},
+	}
+	for _, tt := range tests {
+		if got := float64(mustEval(t, NewSession(), tt.src)); math.Abs(got-tt.want) > 1e-15 {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestBitwiseNot(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"~0", -1},
+		{"~5", -6},
+		{"~-1", 0},
+		{"~~7", 7},
+		{"-~5", 6},
+	})
+	for _, src := range []string{"~1.5", "~nan", "~inf"} {
+		if _, err := NewSession().Eval(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+}
+
+func TestMaxInput(t *testing.T) {
+	saved := maxInput
+	defer func() { maxInput = saved }()
+	maxInput = 10
+	if v, err := EvalString("1 + 2"); err != nil || v != 3 {
+		t.Errorf("1 + 2: %v %v", v, err)
+	}
+	long := "1 + 2 + 3 + 4"
+	if _, err := Parse(long); err == nil || !strings.Contains(err.Error(), "input too long") {
+		t.Errorf("Parse: %v", err)
+	}
+	if _, err := EvalString(long); err == nil || !strings.Contains(err.Error(), "input too long") {
+		t.Errorf("EvalString: %v", err)
+	}
+	if _, err := EvalAll(long); err == nil || !strings.Contains(err.Error(), "input too long") {
+		t.Errorf("EvalAll: %v", err)
+	}
+	if _, err := NewSession().Eval(long); err == nil || !strings.Contains(err.Error(), "input too long") {
+		t.Errorf("Session.Eval: %v", err)
+	}
+	// 既定の上限は有限
+	maxInput = saved
+	if _, err := Parse(strings.Repeat("1+", maxInput) + "1"); err == nil {
+		t.Error("default limit: no error")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	a, b := NewSession(), NewSession()
+	mustEval(t, a, "x = 1", "def f(y) = y + 10", "deg", "push 3", "precision 2")
+	mustEval(t, b, "x = 2", "def f(y) = y * 10")
+	if v := mustEval(t, a, "f(x)"); v != 11 {
+		t.Errorf("f(x) in a = %v", v)
+	}
+	if v := mustEval(t, b, "f(x)"); v != 20 {
+		t.Errorf("f(x) in b = %v", v)
+	}
+	if v := mustEval(t, b, "sin(acos(-1) / 2)"); v != 1 {
+		t.Errorf("sin(acos(-1) / 2) in b = %v (angle mode leaked)", v)
+	}
+	if v := mustEval(t, a, "sin(90)"); v != 1 {
+		t.Errorf("sin(90) in a = %v", v)
+	}
+	if len(b.stack) != 0 || b.precision != -1 || len(a.stack) != 1 || a.precision != 2 {
+		t.Errorf("stack or precision leaked: a %v %v, b %v %v", a.stack, a.precision, b.stack, b.precision)
+	}
+	if _, err := EvalString("x"); err == nil {
+		t.Error("x in the default session: no error")
+	}
+	if _, ok := NewSession().funcs["f"]; ok {
+		t.Error("a new session has a user function")
+	}
+
+	// 式の値は ans に入り、コマンドの表示は EvalTo の出力先に書く
+	var out bytes.Buffer
+	c := NewSession()
+	for _, src := range []string{"6 * 7", "M+", "MR", "push ans", "ans"} {
+		if _, err := c.EvalTo(&out, src); err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+	}
+	if got := out.String(); got != "42\n42\n42\n" {
+		t.Errorf("output of M+, MR and push = %q", got)
+	}
+
+	// セッションの外の状態を変えるコマンドは使えない
+	for _, src := range []string{`load "/etc/hostname"`, "maxinput 0", "maxcost 0", "cache 100", "maxdepth 1000000"} {
+		if _, err := a.Eval(src); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("%s: %v", src, err)
+		}
+	}
+
+	// 別のセッションを同時に使っても競合しない (go test -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := NewSession()
+			for j := 0; j < 50; j++ {
+				v, err := s.Eval(fmt.Sprintf("n = %d + %d", i, j))
+				if err != nil || v != Value(i+j) {
+					t.Errorf("session %d: %v %v", i, v, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestElvis(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"y ?: 3", 3},
+		{"nan ?: 4", 4},
+		{"sqrt(-1) ?: 5", 5},
+		{"z ?: w ?: 7", 7},
+		{"0 ?: 8", 0},
+		{"2 + (y ?: 1) * 3", 5},
+	})
+	if v := mustEval(t, NewSession(), "x = 2", "x ?: 3"); v != 2 {
+		t.Errorf("x ?: 3 with x = 2: %v", v)
+	}
+	// 未束縛の変数以外のエラーは隠さない
+	if _, err := NewSession().Eval("pow(2) ?: 1"); err == nil {
+		t.Error("pow(2) ?: 1: no error")
+	}
+}
+
+func TestMinMaxNaN(t *testing.T) {
+	s := NewSession()
+	for _, src := range []string{"min(1, nan, 2)", "max(nan, 1)", "max(1, 2, nan)"} {
+		if v := mustEval(t, s, src); !math.IsNaN(float64(v)) {
+			t.Errorf("%s = %v, want NaN", src, v)
+		}
+	}
+	mustEval(t, s, "nanskip on")
+	checks := []evalTest{
+		{"min(1, nan, 2)", 1},
+		{"max(nan, 1)", 1},
+		{"max(1, 2, nan)", 2},
+		{"min(nan, -inf)", Value(math.Inf(-1))},
+	}
+	for _, tt := range checks {
+		if got := mustEval(t, s, tt.src); got != tt.want {
+			t.Errorf("%s with nanskip = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+	if v := mustEval(t, s, "max(nan, nan)"); !math.IsNaN(float64(v)) {
+		t.Errorf("max(nan, nan) with nanskip = %v, want NaN", v)
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	s := NewSession()
+	if v := mustEval(t, s, "x = 0", "repeat(x = x + 1, 1000)"); v != 1000 {
+		t.Errorf("repeat(x = x + 1, 1000) = %v", v)
+	}
+	if v := mustEval(t, s, "x = 1", "n = 3", "repeat(x = x * 2, n)"); v != 8 {
+		t.Errorf("repeat(x = x * 2, n) = %v", v)
+	}
+	if v := mustEval(t, s, "repeat(1, 0)"); v != 0 {
+		t.Errorf("repeat(1, 0) = %v", v)
+	}
+	for _, src := range []string{"repeat(1, -1)", "repeat(1, 1.5)", "repeat(1, nan)"} {
+		if _, err := s.Eval(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+	// 回数が見積もれなくても、評価中に手間の上限で止まる
+	s.maxCost = 10000
+	mustEval(t, s, "n = 1e12")
+	for _, src := range []string{"repeat(1, 1e12)", "repeat(x = x + 1, n)"} {
+		if _, err := s.Eval(src); err == nil || !strings.Contains(err.Error(), "maxcost") {
+			t.Errorf("%s: %v", src, err)
+		}
+	}
+}
+
+func TestAssert(t *testing.T) {
+	s := NewSession()
+	if v := mustEval(t, s, "assert(sqrt(4) == 2)"); v != 1 {
+		t.Errorf("passing assert = %v", v)
+	}
+	tests := []struct{ src, want string }{
+		{"assert(1 == 2)", "assertion failed: 1 == 2"},
+		{`assert(0, "boom")`, "assertion failed: boom"},
+	}
+	for _, tt := range tests {
+		if _, err := s.Eval(tt.src); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+// 新しいセッションを既定のセッションにして f を呼ぶ (EvalString などの大域の状態を使う関数のテスト)
+func withSession(f func()) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	s := NewSession()
+	s.swap()
+	defer s.swap()
+	f()
+}
+
+func TestEvalAll(t *testing.T) {
+	withSession(func() {
+		vs, err := EvalAll("a = 2; b = a * 3; a + b")
+		if err != nil || fmt.Sprint(vs) != "[2 6 8]" {
+			t.Errorf("EvalAll: %v %v", vs, err)
+		}
+		// 最初のエラーで止め、それまでの結果を返す
+		vs, err = EvalAll("c = 1; d; c = 2;")
+		if err == nil || fmt.Sprint(vs) != "[1]" {
+			t.Errorf("EvalAll with an error: %v %v", vs, err)
+		}
+		if v, _ := EvalString("c"); v != 1 {
+			t.Errorf("c after the error = %v", v)
+		}
+		if vs, err := EvalAll(""); err != nil || len(vs) != 0 {
+			t.Errorf("EvalAll of nothing: %v %v", vs, err)
+		}
+	})
+}
+
+func TestEvalStream(t *testing.T) {
+	defer func() {
+		stateMu.Lock()
+		delete(globalEnv, "streamx")
+		stateMu.Unlock()
+	}()
+	r, w := io.Pipe()
+	results := make(chan Result)
+	go EvalStream(r, results)
+	io.WriteString(w, "streamx = 20;\n")
+	if res := <-results; res.Value != 20 || res.Err != nil {
+		t.Errorf("streamx = 20: %v", res)
+	}
+
+	// 入力を待つ間はほかのセッションの評価を止めない (-race で競合も調べる)
+	done := make(chan Value)
+	go func() {
+		v, _ := NewSession().Eval("1 + 2")
+		done <- v
+	}()
+	select {
+	case v := <-done:
+		if v != 3 {
+			t.Errorf("1 + 2 in a session = %v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session.Eval blocked while EvalStream waited for input")
+	}
+
+	go func() {
+		io.WriteString(w, "streamy; streamx + 1;\nstreamx * 2")
+		w.Close()
+	}()
+	if res := <-results; res.Err == nil {
+		t.Errorf("streamy: %v", res)
+	}
+	if res := <-results; res.Value != 21 || res.Err != nil {
+		t.Errorf("streamx + 1: %v", res)
+	}
+	if res := <-results; res.Value != 40 || res.Err != nil {
+		t.Errorf("streamx * 2: %v", res)
+	}
+	if res, ok := <-results; ok {
+		t.Errorf("result after EOF: %v", res)
+	}
+}
+
+func TestSigfig(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"sigfig(12345, 2)", 12000},
+		{"sigfig(0.012345, 2)", 0.012},
+		{"sigfig(-12345, 3)", -12300},
+		{"sigfig(1.5e-10, 1)", 2e-10},
+		{"sigfig(6.02214076e23, 3)", 6.02e23},
+		{"sigfig(9.99, 2)", 10},
+		{"sigfig(0, 3)", 0},
+	})
+	if _, err := NewSession().Eval("sigfig(1, 0)"); err == nil {
+		t.Error("sigfig(1, 0): no error")
+	}
+}
+
+func TestEvalCSE(t *testing.T) {
+	withSession(func() {
+		EvalString("x = 0.7")
+		for _, src := range []string{
+			"sin(x)*sin(x) + sin(x)",
+			"(x + 1)^2 - (x + 1)^2 / (x + 1)",
+			"max(sqrt(x), sqrt(x), 1 / sqrt(x))",
+			"y = x * 2",
+			"incr(x) + incr(x)",
+		} {
+			e := parseString(src)
+			saved := globalEnv["x"]
+			want := EvalResult(e)
+			globalEnv["x"] = saved
+			got, err := EvalCSE(e)
+			globalEnv["x"] = saved
+			if got != want.Value || err != want.Err {
+				t.Errorf("EvalCSE(%s) = %v %v, want %v %v", src, got, err, want.Value, want.Err)
+			}
+		}
+
+		// まとめた構文木を使い回しても、覚えた値は評価ごとに計算し直す
+		e := parseString("sin(x) + sin(x) * 2")
+		for _, x := range []Value{0.5, 1, 0.5} {
+			globalEnv["x"] = x
+			want := math.Sin(float64(x)) * 3
+			if got, err := EvalCSE(e); err != nil || math.Abs(float64(got)-want) > 1e-15 {
+				t.Errorf("EvalCSE(%s) with x = %v: %v %v, want %v", e, x, got, err, want)
+			}
+		}
+	})
+}
+
+// 同じ重い部分式を繰り返す式では、部分式をまとめて評価の回数を減らせる
+func BenchmarkEvalCSE(b *testing.B) {
+	withSession(func() {
+		EvalString("x = 0.7")
+		t := "(sin(x)*cos(x) + exp(x)/sqrt(x) + atan(x)*log(x))"
+		e := parseString(t + "^2 + 3*" + t + " - 1/" + t + " + sqrt(" + t + ")")
+		b.Run("naive", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				EvalResult(e)
+			}
+		})
+		b.Run("cse", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				EvalCSE(e)
+			}
+		})
+	})
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"2*3+sin(0)", "6"},
+		{"x*(2+3)", "x*5"},
+		{"2^10 + y", "1024 + y"},
+		{"x + 0", "x + 0"},
+		{"x = 2 + 3", "x = 5"},
+	}
+	for _, tt := range tests {
+		got, want := Fold(parseString(tt.src)), parseString(tt.want)
+		if Hash(got) != Hash(want) {
+			t.Errorf("Fold(%s) differs from %s", tt.src, tt.want)
+		}
+	}
+	out := repl(t, "fold 2*3+sin(0);\n")
+	if out != "Value(6)\n" {
+		t.Errorf("fold command: %q", out)
+	}
+}
+
+func TestSort(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"sort(3, 1, 2).0", 1},
+		{"sort(3, 1, 2).2", 3},
+		{"sort(inf, 1, -inf, 0).0", Value(math.Inf(-1))},
+		{"sort(inf, 1, -inf, 0).3", Value(math.Inf(1))},
+		{"sort(nan, 1, -inf, inf, 0).3", Value(math.Inf(1))},
+	})
+	// NaN は最後に置く
+	if v := mustEval(t, NewSession(), "sort(nan, 1, -inf, inf, 0).4"); !math.IsNaN(float64(v)) {
+		t.Errorf("sort(...).4 = %v, want NaN", v)
+	}
+	if _, err := NewSession().Eval("sort(3, 1).2"); err == nil {
+		t.Error("sort(3, 1).2: no error")
+	}
+}
+
+func TestDisplay(t *testing.T) {
+	out := repl(t, "0.1 + 0.2;\n0.1;\n1/3;\n1e21;\n0.25 + 0.5;\nprecision 3;\n1/3;\nprecision -1;\n1/3;\n")
+	want := "0.30000000000000004\n0.1\n0.3333333333333333\n1e+21\n0.75\n0.333\n0.3333333333333333\n"
+	if out != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+	for _, x := range []float64{0.1, 1.0 / 3, math.Pi, 1e-300, 123456789.123} {
+		s := formatValue(Value(x))
+		if y, err := strconv.ParseFloat(s, 64); err != nil || y != x {
+			t.Errorf("%v displays as %s", x, s)
+		}
+	}
+}
+
+func TestUndo(t *testing.T) {
+	s := NewSession()
+	mustEval(t, s, "x = 1", "x = 2", "y = 3")
+	if v := mustEval(t, s, "undo", "y ?: -1"); v != -1 {
+		t.Errorf("y after undo = %v", v)
+	}
+	if v := mustEval(t, s, "x"); v != 2 {
+		t.Errorf("x after undo = %v", v)
+	}
+	if _, err := s.Eval("undo"); err == nil || !strings.Contains(err.Error(), "nothing to undo") {
+		t.Errorf("second undo: %v", err)
+	}
+	// 関数の呼び出しは取り消す代入を上書きしない
+	mustEval(t, s, "def f(a) = a * 2", "x = 5", "f(3)", "undo")
+	if v := mustEval(t, s, "x"); v != 2 {
+		t.Errorf("x after f(3) and undo = %v", v)
+	}
+	// 一つの文の代入はまとめて戻す
+	mustEval(t, s, "a = b = 7", "undo")
+	if v := mustEval(t, s, "(a ?: 0) + (b ?: 0)"); v != 0 {
+		t.Errorf("a + b after undo = %v", v)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s := NewSession()
+	mustEval(t, s, "a = 1", "def g(n) = (a = n) + nope")
+	for _, src := range []string{"(a = 2) + nope", "b = (a = 3) * nope", "g(4)", "c = (a = 5) / nope"} {
+		if _, err := s.Eval(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+		if v := mustEval(t, s, "a"); v != 1 {
+			t.Errorf("a after %s = %v", src, v)
+		}
+		if v := mustEval(t, s, "b ?: 0"); v != 0 {
+			t.Errorf("b after %s = %v", src, v)
+		}
+	}
+	// ライブラリの入口でも同じように戻す
+	withSession(func() {
+		EvalString("a = 1")
+		if _, err := EvalString("(a = 2) + nope"); err == nil {
+			t.Error("EvalString: no error")
+		}
+		if r := EvalResult(parseString("(a = 3) + nope")); r.Err == nil {
+			t.Error("EvalResult: no error")
+		}
+		if _, err := EvalAll("a = 4; (a = 5) + nope"); err == nil {
+			t.Error("EvalAll: no error")
+		}
+		if v, _ := EvalString("a"); v != 4 {
+			t.Errorf("a = %v, want 4", v)
+		}
+	})
+}
+
+func TestDMS(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"30d15m20s", Value(30 + 15.0/60 + 20.0/3600)},
+		{"30d", 30},
+		{"10d30m", 10.5},
+		{"-30d15m", -30.25},
+		{"1d30m + 1d30m", 3},
+	})
+	out := repl(t, "dms on;\n30d15m20s;\n-1.5;\n45;\ndms off;\n30d15m20s;\n")
+	want := "30d15m20s\n-1d30m0s\n45d0m0s\n30.255555555555556\n"
+	if out != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestRange(t *testing.T) {
+	s := NewSession()
+	mustEval(t, s, "range x [0, 10]", "x = 0", "x = 10", "x = 5.5")
+	for _, src := range []string{"x = 20", "x = -1", "x = nan"} {
+		if _, err := s.Eval(src); err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%s: %v", src, err)
+		}
+	}
+	if v := mustEval(t, s, "x"); v != 5.5 {
+		t.Errorf("x = %v", v)
+	}
+	// 範囲はセッションごと
+	mustEval(t, NewSession(), "x = 20")
+}
+
+func TestDefined(t *testing.T) {
+	s := NewSession()
+	if v := mustEval(t, s, "defined(x)"); v != 0 {
+		t.Errorf("defined(x) = %v", v)
+	}
+	if v := mustEval(t, s, "x = 1", "defined(x)"); v != 1 {
+		t.Errorf("defined(x) after x = 1: %v", v)
+	}
+	if v := mustEval(t, s, `defined("x")`, `defined("y")`); v != 0 {
+		t.Errorf(`defined("y") = %v`, v)
+	}
+	if v := mustEval(t, s, `defined("x")`); v != 1 {
+		t.Errorf(`defined("x") after x = 1: %v`, v)
+	}
+	// 関数の名前は変数ではない
+	if v := mustEval(t, s, "def f() = 1", "defined(f)", `defined("sin")`); v != 0 {
+		t.Errorf(`defined("sin") = %v`, v)
+	}
+	if v := mustEval(t, s, "defined(f)"); v != 0 {
+		t.Errorf("defined(f) = %v", v)
+	}
+	if _, err := s.Eval("defined(1)"); err == nil {
+		t.Error("defined(1): no error")
+	}
+	// 評価の時点で結果が変わるので共通部分式にしない
+	if pure(parseString("defined(x) + defined(x)")) {
+		t.Error("defined is treated as pure")
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	s := NewSession()
+	checks := []evalTest{
+		{"x = 1", 1},
+		{"incr(x)", 2},
+		{"incr(x, 5)", 7},
+		{"decr(x)", 6},
+		{"decr(x, 0.5)", 5.5},
+		{"x", 5.5},
+	}
+	for _, tt := range checks {
+		if got := mustEval(t, s, tt.src); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+	for _, src := range []string{"incr(q)", "incr(2)", "incr(x, 1, 2)"} {
+		if _, err := s.Eval(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+}
+
+func TestTableAlignment(t *testing.T) {
+	out := repl(t, "table(x^2/4, x, 1, 11, 5);\n")
+	want := " 1   0.25\n 6   9\n11  30.25\n3\n"
+	if out != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+	// 小数点がコンマでも表示の小数点は . なので、桁の区切りのコンマではそろえない
+	out = repl(t, "decimalsep comma;\ngrouping on;\ntable(x*600,25; x; 1; 2; 1);\n")
+	want = "1    600.25\n2  1,200.5\n2\n"
+	if out != want {
+		t.Errorf("output with decimalsep comma:\n%s\nwant:\n%s", out, want)
+	}
+	saved := tableWidth
+	defer func() { tableWidth = saved }()
+	out = repl(t, "tablewidth 8;\ntable(x/2, x, -1, 1, 1);\n")
+	want = "      -1      -0.5\n       0       0\n       1       0.5\n3\n"
+	if out != want {
+		t.Errorf("output with tablewidth 8:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestToFraction(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"tofraction(0.75);", "3/4\n0.75\n"},
+		{"tofraction(0.333333);", "1/3\n0.3333333333333333\n"},
+		{"tofraction(-1.5);", "-3/2\n-1.5\n"},
+		{"tofraction(acos(-1), 1e-3);", "22/7\n3.142857142857143\n"},
+		{"tofraction(4);", "4\n4\n"},
+	}
+	for _, tt := range tests {
+		if out := repl(t, tt.src+"\n"); out != tt.want {
+			t.Errorf("%s: %q, want %q", tt.src, out, tt.want)
+		}
+	}
+	for _, src := range []string{"tofraction()", "tofraction(1, 2, 3)", "tofraction(nan)"} {
+		if _, err := NewSession().Eval(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"x = 1;\nx = 2;\n", "variable x assigned but never used before reassignment\nvariable x assigned but never used\n"},
+		{"y = 1;\neval(\"y\");\n", ""},
+		{"x = 5;\ndef f() = x;\nf();\n", ""},
+		{"x = 5;\ndef g(x) = x * 2;\ng(1);\n", "variable x assigned but never used\n"},
+		{"x = 5;\ndef h(n) = if(n > 0, h(n - 1), x);\nh(2);\n", ""},
+		{"z = 1;\neval(\"k(z)\");\ndef k(a) = a;\n", ""},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(t.TempDir(), "lint.calc")
+		if err := os.WriteFile(name, []byte(tt.src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		out := repl(t, "lint on;\nload \""+name+"\";\n")
+		var warns []string
+		for _, line := range strings.SplitAfter(out, "\n") {
+			if w, ok := strings.CutPrefix(line, "warning: "+name+": "); ok {
+				warns = append(warns, w)
+			}
+		}
+		if got := strings.Join(warns, ""); got != tt.want {
+			t.Errorf("%q: warnings %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	checkValues(t, []evalTest{
+		{`eval("2 + 3")`, 5},
+		{`eval("eval(\"1 + 1\")") * 2`, 4},
+	})
+	s := NewSession()
+	if v := mustEval(t, s, "x = 4", `eval("x * 2")`); v != 8 {
+		t.Errorf(`eval("x * 2") = %v`, v)
+	}
+	if v := mustEval(t, s, `eval("y = 3")`, "y"); v != 3 {
+		t.Errorf(`y after eval("y = 3") = %v`, v)
+	}
+	if _, err := s.Eval(`eval("1 +")`); err == nil || !strings.HasPrefix(err.Error(), "eval:") {
+		t.Errorf(`eval("1 +"): %v`, err)
+	}
+	// 自分自身を評価し続けても深さの上限で止まる
+	if _, err := s.Eval(`def f() = eval("f()")`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Eval("f()"); err == nil || !strings.Contains(err.Error(), "maximum recursion depth") {
+		t.Errorf("f(): %v", err)
+	}
+}
+
+func TestArityError(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"pow(2)", "pow expects 2 arguments, got 1 (usage: pow(base, exp))"},
+		{"pow(1, 2, 3)", "pow expects 2 arguments, got 3 (usage: pow(base, exp))"},
+		{"sin()", "sin expects 1 argument, got 0 (usage: sin(x))"},
+		{"sin(1, 2)", "sin expects 1 argument, got 2"},
+	}
+	for _, tt := range tests {
+		if _, err := NewSession().Eval(tt.src); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	s := NewSession()
+	mustEval(t, s, "x = 1", "freeze")
+	if _, err := s.Eval("x = 2"); err == nil || !strings.Contains(err.Error(), "frozen") {
+		t.Errorf("x = 2 while frozen: %v", err)
+	}
+	// 新しい変数は作れる
+	if v := mustEval(t, s, "y = 3", "y = 4"); v != 4 {
+		t.Errorf("y = %v", v)
+	}
+	if v := mustEval(t, s, "unfreeze", "x = 2"); v != 2 {
+		t.Errorf("x = 2 after unfreeze: %v", v)
+	}
+	// 凍結はセッションごと
+	mustEval(t, s, "freeze")
+	mustEval(t, NewSession(), "x = 1", "x = 2")
+}
+
+func TestWatch(t *testing.T) {
+	out := repl(t, "watch x;\nx = 5;\nx = x + 1;\ny = 2;\nunwatch x;\nx = 7;\n")
+	want := "x -> 5\nx = 5\nx -> 6\nx = 6\ny = 2\nx = 7\n"
+	if out != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestEvalResult(t *testing.T) {
+	withSession(func() {
+		if r := EvalResult(parseString("2 + 3")); r.Value != 5 || r.Err != nil {
+			t.Errorf("2 + 3: %+v", r)
+		}
+		r := EvalResult(parseString("nope + 1"))
+		if _, ok := r.Err.(unboundError); !ok {
+			t.Errorf("nope + 1: %+v", r)
+		}
+		maxCost = 100
+		if r := EvalResult(parseString("repeat(1, 1000)")); r.Err == nil || !strings.Contains(r.Err.Error(), "maxcost") {
+			t.Errorf("repeat(1, 1000) with maxcost 100: %+v", r)
+		}
+	})
+}
+
+func TestHistogram(t *testing.T) {
+	saved := binWidth
+	defer func() { binWidth = saved }()
+	tests := []struct{ src, want string }{
+		{"histogram(1, 2, 2, 3, 3, 3);", "1  1  #\n2  2  ##\n3  3  ###\n"},
+		{"binwidth 2;\nhistogram(1, 2, 2, 3, 3, 3);", "[0, 2)  1  #\n[2, 4)  5  #####\n"},
+		// 0.3 / 0.1 は 2.9999999999999996 になるが 0.3 の区間に入れる
+		{"binwidth 0.1;\nhistogram(0.1, 0.2, 0.3, 0.3, 0.7);", "[0.1, 0.2)  1  #\n[0.2, 0.3)  1  #\n[0.3, 0.4)  2  ##\n[0.7, 0.8)  1  #\n"},
+	}
+	for _, tt := range tests {
+		binWidth = saved
+		if out := repl(t, tt.src+"\n"); out != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.src, out, tt.want)
+		}
+	}
+}
+
+func TestIf(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"if(1 > 0, 1, -1)", 1},
+		{"if(0, 1, -1)", -1},
+		{"if(1, 2, nope)", 2},
+		{"if(0, 1 / nope, 3)", 3},
+	})
+	// 選ばなかった方は評価しない
+	s := NewSession()
+	if v := mustEval(t, s, "y = 0", "if(1, 5, y = 9)", "y"); v != 0 {
+		t.Errorf("y after if(1, 5, y = 9) = %v", v)
+	}
+	if v := mustEval(t, s, "if(0, y = 8, 5)", "y"); v != 0 {
+		t.Errorf("y after if(0, y = 8, 5) = %v", v)
+	}
+	if _, err := s.Eval("if(1, 2)"); err == nil {
+		t.Error("if(1, 2): no error")
+	}
+}
+
+func TestEnv(t *testing.T) {
+	out := repl(t, "x = 2;\nenv;\n")
+	for _, want := range []string{"  x = 2\n", " divmod/2 ", " sort/n ", " sqrt/1 ", " table "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("env output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	checkValues(t, []evalTest{
+		{`convert(100, "celsius", "fahrenheit")`, 212},
+		{"convert(212, fahrenheit, celsius)", 100},
+		{"convert(-40, celsius, fahrenheit)", -40},
+		{"convert(20, celsius, fahrenheit)", 68},
+		{"convert(0, celsius, kelvin)", 273.15},
+		{"convert(32, fahrenheit, kelvin)", 273.15},
+		{"convert(1, mile, km)", 1.609344},
+	})
+	if _, err := NewSession().Eval("convert(1, km, kg)"); err == nil {
+		t.Error("convert(1, km, kg): no error")
+	}
+}
+
+func TestCurrency(t *testing.T) {
+	sym, digits := currencySymbol, currencyDigits
+	defer func() { currencySymbol, currencyDigits = sym, digits }()
+	tests := []struct{ src, want string }{
+		{"currency(1234.5);", "$1,234.50\n1234.5\n"},
+		{"currency(-1234.5);", "-$1,234.50\n-1234.5\n"},
+		{"currency(0);", "$0.00\n0\n"},
+		{"currency(999.999);", "$1,000.00\n999.999\n"},
+		{`currency(1e6, "EUR ");`, "EUR 1,000,000.00\n1e+06\n"},
+		{`currencyfmt "€" 0;` + "\ncurrency(1234.4);", "€1,234\n1234.4\n"},
+	}
+	for _, tt := range tests {
+		if out := repl(t, tt.src+"\n"); out != tt.want {
+			t.Errorf("%s: %q, want %q", tt.src, out, tt.want)
+		}
+	}
+}
+
+func TestUndefinedZero(t *testing.T) {
+	s := NewSession()
+	if _, err := s.Eval("zz + 1"); err == nil {
+		t.Error("zz + 1: no error")
+	}
+	if v := mustEval(t, s, "undefined zero", "zz + 1"); v != 1 {
+		t.Errorf("zz + 1 with undefined zero = %v", v)
+	}
+	if _, err := s.Eval("undefined error"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Eval("zz"); err == nil {
+		t.Error("zz after undefined error: no error")
+	}
+	// モードはセッションごと
+	mustEval(t, s, "undefined zero")
+	if _, err := NewSession().Eval("zz"); err == nil {
+		t.Error("zz in a new session: no error")
+	}
+}
+
+func TestPiecewise(t *testing.T) {
+	s := NewSession()
+	mustEval(t, s, "def sgn(x) = piecewise(x < 0, -1, x > 0, 1, 0)")
+	for _, tt := range []evalTest{{"sgn(-3)", -1}, {"sgn(0)", 0}, {"sgn(2)", 1}} {
+		if got := mustEval(t, s, tt.src); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+	// 選ばれなかった枝は評価しない
+	if v := mustEval(t, s, "piecewise(1, 2, nope, 3, 0)"); v != 2 {
+		t.Errorf("piecewise(1, 2, nope, 3, 0) = %v", v)
+	}
+	if _, err := s.Eval("piecewise(0, 1)"); err == nil {
+		t.Error("piecewise(0, 1): no error")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	out := repl(t, "compare(0.1 + 0.2, 0.3);\ncompare(2, 2);\n")
+	want := "absolute error: 5.551115123125783e-17\nrelative error: 1.8503717077085943e-16\n" +
+		"absolute error: 0\nrelative error: 0\n"
+	if out != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestArgumentOrder(t *testing.T) {
+	s := NewSession()
+	mustEval(t, s, "def f(a, b) = a * 10 + b")
+	checks := []evalTest{
+		{"f((x = 1), x + 1)", 12},
+		{"max((y = 2), y * 3, (y = 10))", 10},
+		{"y", 10},
+		{"f((x = 2), f((x = 3), x))", 53},
+		{"x", 3},
+	}
+	for _, tt := range checks {
+		if got := mustEval(t, s, tt.src); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestRawString(t *testing.T) {
+	_, err := NewSession().Eval("assert(0, `say \"hi\"`)")
+	if err == nil || err.Error() != `assertion failed: say "hi"` {
+		t.Errorf("raw string message: %v", err)
+	}
+	if v := mustEval(t, NewSession(), "eval(`1 +\n2`)"); v != 3 {
+		t.Errorf("multi-line raw string = %v", v)
+	}
+}
+
+func TestChainedAssignment(t *testing.T) {
+	s := NewSession()
+	if v := mustEval(t, s, "a = b = c = 5"); v != 5 {
+		t.Errorf("a = b = c = 5 returned %v", v)
+	}
+	if v := mustEval(t, s, "a + b + c"); v != 15 {
+		t.Errorf("a + b + c = %v", v)
+	}
+	if v := mustEval(t, s, "a = (b = (c = 2) + 1) + 1", "a * 100 + b * 10 + c"); v != 432 {
+		t.Errorf("nested assignment: %v", v)
+	}
+	if out := repl(t, "a = b = c = 5;\n"); out != "a = b = c = 5\n" {
+		t.Errorf("display: %q", out)
+	}
+}
+
+// quietassign on で代入も値だけを表示する (以前の表示)
+func TestQuietAssign(t *testing.T) {
+	out := repl(t, "x = 5;\nquietassign on;\nx = 6;\na = b = 3;\nquietassign off;\nx = 7;\n")
+	if want := "x = 5\n6\n3\nx = 7\n"; out != want {
+		t.Errorf("output %q, want %q", out, want)
+	}
+}
+
+func TestExpm1Log1p(t *testing.T) {
+	s := NewSession()
+	const x = 1e-10
+	exact := x + x*x/2
+	if d := math.Abs(float64(mustEval(t, s, "expm1(1e-10)")) - exact); d > 1e-25 {
+		t.Errorf("expm1(1e-10) error %v", d)
+	}
+	// exp(x) - 1 は桁落ちで誤差が大きい
+	if d := math.Abs(float64(mustEval(t, s, "exp(1e-10) - 1")) - exact); d < 1e-18 {
+		t.Errorf("exp(1e-10) - 1 error %v is unexpectedly small", d)
+	}
+	if d := math.Abs(float64(mustEval(t, s, "log1p(1e-10)")) - (x - x*x/2)); d > 1e-25 {
+		t.Errorf("log1p(1e-10) error %v", d)
+	}
+	checkValues(t, []evalTest{{"exp2(10)", 1024}, {"exp2(-1)", 0.5}})
+}
+
+func TestInexactLiteral(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"9007199254740992;", "9.007199254740992e+15\n"},
+		{"9007199254740993;", "warning: integer literal 9007199254740993 is not exact in float64 (9007199254740992)\n9.007199254740992e+15\n"},
+		{"2^53 + 1 == 2^53;", "1\n"},
+	}
+	for _, tt := range tests {
+		if out := repl(t, tt.src+"\n"); out != tt.want {
+			t.Errorf("%s: %q, want %q", tt.src, out, tt.want)
+		}
+	}
+}
+
+func TestDivmod(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"divmod(7, 3).0", 2},
+		{"divmod(7, 3).1", 1},
+		{"divmod(-7, 3).0", -3},
+		{"divmod(-7, 3).1", 2},
+	})
+	for _, src := range []string{"divmod(7, 3)", "divmod(7, 3).2"} {
+		if _, err := NewSession().Eval(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	same := [][2]string{
+		{"x + 1", "x+1"},
+		{"sin(x) * 2", "(sin(x)) * (2)"},
+		{"a = b = 3", "a = (b = 3)"},
+		{`currency(x, "€")`, `currency(x,"€")`},
+		{"assert(x > 0)", "assert(x>0)"},
+	}
+	for _, p := range same {
+		if Hash(parseString(p[0])) != Hash(parseString(p[1])) {
+			t.Errorf("Hash(%s) != Hash(%s)", p[0], p[1])
+		}
+	}
+	differ := [][2]string{
+		{"x + 1", "1 + x"},
+		{"x - 1", "x + 1"},
+		{"x", "y"},
+		{"sin(x)", "cos(x)"},
+		{"1", "1.0000000000000002"},
+		{"a = 3", "a := 3"},
+		{`currency(1, "€")`, `currency(1, "$")`},
+		{`currency(1, "$")`, "currency(1)"},
+		{`assert(x > 0, "a")`, `assert(x > 0, "b")`},
+	}
+	for _, p := range differ {
+		if Hash(parseString(p[0])) == Hash(parseString(p[1])) {
+			t.Errorf("Hash(%s) == Hash(%s)", p[0], p[1])
+		}
+	}
+}
+
+func TestBits(t *testing.T) {
+	out := repl(t, "bits(1);\nbits(-2);\n")
+	want := "hex:      0x3ff0000000000000\nsign:     0\nexponent: 1023 (2^0)\nmantissa: 0x0000000000000\n" +
+		"hex:      0xc000000000000000\nsign:     1\nexponent: 1024 (2^1)\nmantissa: 0x0000000000000\n"
+	if out != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestCatch(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"catch(1 / nope, 5)", 5},
+		{"catch(2, 5)", 2},
+		{"catch(pow(2, 1) + nope, -1)", -1},
+		{"catch(catch(nope, nope2), 7)", 7},
+	})
+	// 既定値は必要なときだけ評価する
+	if v := mustEval(t, NewSession(), "y = 0", "catch(1, y = 9)", "y"); v != 0 {
+		t.Errorf("y after catch(1, y = 9) = %v", v)
+	}
+}
+
+func TestSIPrefix(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{1234567, "1.234567M"},
+		{0.000012, "12µ"},
+		{999999, "999.999k"},
+		{12, "12"},
+		{1e9, "1G"},
+		{-2500, "-2.5k"},
+		{0.5, "500m"},
+	}
+	for _, tt := range tests {
+		if got := formatSI(tt.v); got != tt.want {
+			t.Errorf("formatSI(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+	// 丸めで 1000 に繰り上がったら次の接頭辞にする
+	saved := precision
+	defer func() { precision = saved }()
+	precision = 1
+	if got := formatSI(999999); got != "1.0M" {
+		t.Errorf("formatSI(999999) with precision 1 = %q", got)
+	}
+}
+
+func TestArg(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"arg(1)", 0},
+		{"arg(-1)", math.Pi},
+		{"phase(-0.5)", math.Pi},
+		{"arg(0)", 0},
+	})
+	s := NewSession()
+	if v := mustEval(t, s, "deg", "arg(-1)"); v != 180 {
+		t.Errorf("arg(-1) in deg = %v", v)
+	}
+}
+
+func TestContinuation(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"1 +\n2;\n", "3\n"},
+		{"2 *\n(3 +\n4);\n", "14\n"},
+		{"x =\n5;\nx;\n", "x = 5\n5\n"},
+	}
+	for _, tt := range tests {
+		if out := repl(t, tt.in); out != tt.want {
+			t.Errorf("%q: %q, want %q", tt.in, out, tt.want)
+		}
+	}
+}
+
+func TestCommandNameAsVariable(t *testing.T) {
+	s := NewSession()
+	if v := mustEval(t, s, "M = 5", "2 * M"); v != 10 {
+		t.Errorf("2 * M = %v", v)
+	}
+	if v := mustEval(t, s, "precision := 3", "2 * precision"); v != 6 {
+		t.Errorf("2 * precision = %v", v)
+	}
+	if out := repl(t, "M = 5;\n2 * M;\n"); out != "M = 5\n10\n" {
+		t.Errorf("REPL: %q", out)
+	}
+	// 空白をはさんだ M + 1 は変数 M の式で、M+ だけがメモリのコマンド
+	if out := repl(t, "M = 5;\nM + 1;\nM - 1;\nM+ 2;\nM-;\nMR;\n"); out != "M = 5\n6\n4\n2\n-2\n-2\n" {
+		t.Errorf("M + 1 and M+: %q", out)
+	}
+}
+
+func TestTableLimits(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"table(x, x, 0, inf, 1);", "invalid range: 0 to +Inf\n"},
+		{"table(x, x, nan, 1, 1);", "invalid range: NaN to 1\n"},
+		{"table(x, x, 0, 1, nan);", "invalid step"},
+		{"table(x, x, 0, 1e9, 1);", "too many steps: 1000000001 exceeds 100000\n"},
+	}
+	for _, tt := range tests {
+		if out := repl(t, tt.src+"\n"); !strings.HasPrefix(out, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.src, out, tt.want)
+		}
+	}
+}
+
+func TestLastSize(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"lastsize 1e12;", "lastsize too large: at most 100000\n"},
+		{"lastsize -1;", "lastsize must not be negative\n"},
+		{"lastsize nan;", "lastsize must not be negative\n"},
+		{"lastsize 3;\nlastsize;", "3\n"},
+	}
+	for _, tt := range tests {
+		if out := repl(t, tt.src+"\n"); out != tt.want {
+			t.Errorf("%s: %q, want %q", tt.src, out, tt.want)
+		}
+	}
+}
+
+func TestPlotSize(t *testing.T) {
+	w, h := plotWidth, plotHeight
+	defer func() { plotWidth, plotHeight = w, h }()
+	tests := []struct{ src, want string }{
+		{"plotsize 40 10;\nplotsize;", "40 10\n"},
+		{"plotsize 60 -20;", "plotsize too small\n"},
+		{"plotsize (30 + 10) 10;\nplotsize;", "40 10\n"},
+		{"plotsize 5000 20;", "plotsize too large: at most 1000 500\n"},
+		{"plotsize nan 20;", "plotsize too small\n"},
+	}
+	for _, tt := range tests {
+		if out := repl(t, tt.src+"\n"); out != tt.want {
+			t.Errorf("%s: %q, want %q", tt.src, out, tt.want)
+		}
+	}
+}
+
+func TestFactorial(t *testing.T) {
+	checkValues(t, []evalTest{
+		{"0!", 1},
+		{"5!", 120},
+		{"171!", Value(math.Inf(1))},
+		{"1000!", Value(math.Inf(1))},
+	})
+	for _, src := range []string{"(-1)!", "1.5!"} {
+		if _, err := NewSession().Eval(src); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+	// float64 では 23! から正確でないので警告し、bigfloat では正確に表示する
+	out := repl(t, "22!;\n25!;\nbigfloat on;\n25!;\n")
+	want := "1.1240007277776077e+21\n" +
+		"warning: 25! is not exact in float64 (exact: 15511210043330985984000000; use bigfloat on)\n1.5511210043330986e+25\n" +
+		"15511210043330985984000000\n"
+	if out != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+// 与えた断片を順に返す入力 (空の断片では一度だけ EOF を返す)
+type chunkReader []string
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	c := (*r)[0]
+	*r = (*r)[1:]
+	if c == "" {
+		return 0, io.EOF
+	}
+	return copy(p, c), nil
+}
+
+func TestEOFInContinuation(t *testing.T) {
+	// 継続中の EOF で式を取り消したあとも、続く入力を読み飛ばさずに評価する
+	out := replFrom(t, &chunkReader{"1 +\n", "", "2 + 3;\n4;\n"})
+	if out != "input canceled\n5\n4\n" {
+		t.Errorf("output: %q", out)
+	}
+}